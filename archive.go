@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// archiveRoot holds one archive folder per camera.
+const archiveRoot = "archive"
+
+// ErrArchiveNotFound is returned for names the store did not create.
+var ErrArchiveNotFound = errors.New("archive not found")
+
+// archiveTimeLayout timestamps snapshot names to the millisecond, so
+// snapshots taken within the same second get names of their own.
+const archiveTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// archivePrefixes are the file name prefixes gocam writes into an archive.
+var archivePrefixes = []string{tempStoragePrefix, eventStoragePrefix, snapshotPrefix}
+
+// ArchiveStore owns one camera's archive folder. Every file gocam writes
+// there is registered through Create, and only registered names can be
+// read or deleted, so request input can never reach outside the folder.
+type ArchiveStore struct {
+	dir   string
+	mut   sync.Mutex
+	names map[string]bool
+}
+
+func openArchiveStore(dir string) (*ArchiveStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Pick up recordings written by earlier runs
+	store := &ArchiveStore{dir: dir, names: map[string]bool{}}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() && validArchiveName(file.Name()) {
+			store.names[file.Name()] = true
+		}
+	}
+	return store, nil
+}
+
+// validArchiveName accepts plain file names carrying one of gocam's prefixes.
+func validArchiveName(name string) bool {
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, prefix := range archivePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create registers a new archive name and returns the path to write it to.
+// The file is created empty so that the name is taken; Create fails if a
+// file of that name already exists rather than overwrite it.
+func (s *ArchiveStore) Create(name string) (string, error) {
+	if !validArchiveName(name) {
+		return "", errors.New("invalid archive name " + name)
+	}
+	path := filepath.Join(s.dir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+
+	s.mut.Lock()
+	s.names[name] = true
+	s.mut.Unlock()
+	return path, nil
+}
+
+// path resolves a registered name; anything else is ErrArchiveNotFound.
+func (s *ArchiveStore) path(name string) (string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !validArchiveName(name) || !s.names[name] {
+		return "", ErrArchiveNotFound
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *ArchiveStore) Stat(name string) (os.FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		s.forget(name)
+		return nil, ErrArchiveNotFound
+	}
+	return info, err
+}
+
+// Get opens an archive for reading.
+func (s *ArchiveStore) Get(name string) (*os.File, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		s.forget(name)
+		return nil, ErrArchiveNotFound
+	}
+	return file, err
+}
+
+// List returns every archive that still exists, oldest first.
+func (s *ArchiveStore) List() ([]os.FileInfo, error) {
+	s.mut.Lock()
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	s.mut.Unlock()
+
+	infos := []os.FileInfo{}
+	for _, name := range names {
+		info, err := s.Stat(name)
+		if err == ErrArchiveNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	return infos, nil
+}
+
+func (s *ArchiveStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		s.forget(name)
+	}
+	if os.IsNotExist(err) {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+func (s *ArchiveStore) forget(name string) {
+	s.mut.Lock()
+	delete(s.names, name)
+	s.mut.Unlock()
+}
+
+// readArchive returns the contents of one camera's archive file.
+func readArchive(camera, name string) ([]byte, error) {
+	cam := camerasByID[camera]
+	if cam == nil {
+		return nil, ErrArchiveNotFound
+	}
+	file, err := cam.archive.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidArchiveName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"TMP_2018-10-01T12:00:00Z.avi", true},
+		{"EVT_motion_2018-10-01T12:00:00Z.avi", true},
+		{"EVT_motion_2018-10-01T12:00:00Z.json", true},
+		{"SNAP_doorbell_2018-10-01T12:00:00Z.jpg", true},
+		{"", false},
+		{"..", false},
+		{"../TMP_x.avi", false},
+		{"../../etc/passwd", false},
+		{"/etc/passwd", false},
+		{"/root/archive/TMP_x.avi", false},
+		{"front/TMP_x.avi", false},
+		{"TMP_x/../../secret", false},
+		{`TMP_x\..\secret`, false},
+		{".TMP_x.avi", false},
+		{"x.avi", false},
+		{"tmp_x.avi", false},
+		{"config.yaml", false},
+	}
+	for _, tt := range tests {
+		if got := validArchiveName(tt.name); got != tt.want {
+			t.Errorf("validArchiveName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveStorePath(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "front")
+	if err := os.MkdirAll(filepath.Join(dir, "TMP_folder"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Files outside the archive folder, and ones gocam did not write
+	for _, path := range []string{filepath.Join(root, "TMP_outside.avi"), filepath.Join(dir, "TMP_old.avi"), filepath.Join(dir, "notes.txt")} {
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := openArchiveStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create("EVT_motion_new.avi"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create("../TMP_escape.avi"); err == nil {
+		t.Errorf("Create accepted a name outside the archive")
+	}
+	// Names already taken, by this run or an earlier one, are never reused
+	for _, name := range []string{"EVT_motion_new.avi", "TMP_old.avi"} {
+		if _, err := store.Create(name); !os.IsExist(err) {
+			t.Errorf("Create(%q) = %v, want an error that it exists", name, err)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "TMP_old.avi")); err != nil || string(data) != "x" {
+		t.Errorf("TMP_old.avi = %q, %v after Create, want it untouched", data, err)
+	}
+
+	tests := []struct {
+		name string
+		// want is the path inside dir, or empty for ErrArchiveNotFound
+		want string
+	}{
+		{"TMP_old.avi", "TMP_old.avi"},
+		{"EVT_motion_new.avi", "EVT_motion_new.avi"},
+		{"TMP_unknown.avi", ""},
+		{"notes.txt", ""},
+		{"TMP_folder", ""},
+		{"../TMP_outside.avi", ""},
+		{filepath.Join(root, "TMP_outside.avi"), ""},
+	}
+	for _, tt := range tests {
+		path, err := store.path(tt.name)
+		if tt.want == "" {
+			if err != ErrArchiveNotFound {
+				t.Errorf("path(%q) = %q, %v, want ErrArchiveNotFound", tt.name, path, err)
+			}
+		} else if err != nil || path != filepath.Join(dir, tt.want) {
+			t.Errorf("path(%q) = %q, %v, want %q", tt.name, path, err, filepath.Join(dir, tt.want))
+		}
+	}
+}
+
+func TestArchiveHandler(t *testing.T) {
+	useAuthenticator(t, &Authenticator{})
+	cam := newTestCamera(t, "front")
+	other := newTestCamera(t, "back")
+	useCameras(t, cam, other)
+
+	for _, name := range []string{"TMP_1.avi", "TMP_2.avi", "TMP_gone.avi"} {
+		path, err := cam.archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherPath, err := other.archive.Create("TMP_other.avi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(otherPath, []byte("back"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Removed behind the store's back, e.g. by hand
+	gone, _ := cam.archive.path("TMP_gone.avi")
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"info", "GET", "/api/archives/TMP_1.avi", ArchiveHandler, http.StatusOK},
+		{"delete", "DELETE", "/api/archives/TMP_1.avi", ArchiveHandler, http.StatusOK},
+		{"delete again", "DELETE", "/api/archives/TMP_1.avi", ArchiveHandler, http.StatusNotFound},
+		{"delete a file already gone", "DELETE", "/api/archives/TMP_gone.avi", ArchiveHandler, http.StatusNotFound},
+		{"delete an unknown name", "DELETE", "/api/archives/TMP_never.avi", ArchiveHandler, http.StatusNotFound},
+		{"delete outside the archive", "DELETE", "/api/archives/../TMP_2.avi", ArchiveHandler, http.StatusNotFound},
+		{"delete another camera's file", "DELETE", "/api/archives/TMP_other.avi", ArchiveHandler, http.StatusNotFound},
+		{"delete from another camera", "DELETE", "/api/cameras/back/archives/TMP_other.avi", CameraHandler, http.StatusOK},
+		{"delete from an unknown camera", "DELETE", "/api/cameras/side/archives/TMP_2.avi", CameraHandler, http.StatusNotFound},
+		{"rename", "PUT", "/api/archives/TMP_2.avi", ArchiveHandler, http.StatusMethodNotAllowed},
+		{"download", "GET", "/archives/TMP_2.avi", ServeArchive, http.StatusOK},
+		{"download from a camera", "GET", "/archives/front/TMP_2.avi", ServeArchive, http.StatusOK},
+		{"download from an unknown camera", "GET", "/archives/side/TMP_2.avi", ServeArchive, http.StatusNotFound},
+		{"download through another camera", "GET", "/archives/back/../front/TMP_2.avi", ServeArchive, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		// ServeMux would clean the dot segments, but handlers must not rely on it
+		request := httptest.NewRequest(tt.method, "/", nil)
+		request.URL.Path = tt.path
+		w := httptest.NewRecorder()
+		tt.handler(w, request)
+		if w.Code != tt.want {
+			t.Errorf("%v: %v %v = %d, want %d", tt.name, tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+
+	if _, err := cam.archive.path("TMP_1.avi"); err != ErrArchiveNotFound {
+		t.Errorf("deleted archive still registered")
+	}
+	for _, path := range []string{otherPath, gone} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v still exists", path)
+		}
+	}
+	if _, err := cam.archive.path("TMP_2.avi"); err != nil {
+		t.Errorf("TMP_2.avi was deleted through a bad path")
+	}
+	if _, err := readArchive("side", "TMP_2.avi"); err != ErrArchiveNotFound {
+		t.Errorf("readArchive from an unknown camera = %v, want ErrArchiveNotFound", err)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookie = "gocam_session"
+
+// Role decides what a caller may do. Viewers can watch streams and browse
+// archives and events; admins can also change power state, record and delete.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleAdmin
+)
+
+func parseRole(s string) (Role, error) {
+	switch s {
+	case "viewer":
+		return RoleViewer, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role %q (expected viewer or admin)", s)
+	}
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// UserConfig is one entry of auth.users. PasswordHash is a bcrypt hash as
+// printed by `gocam -hash-password`.
+type UserConfig struct {
+	Username     string
+	PasswordHash string
+	Role         string
+}
+
+// APIKeyConfig is one entry of auth.apiKeys. KeyHash is the hex SHA-256 of
+// the key as printed by `gocam -gen-api-key`; the key itself is never stored.
+type APIKeyConfig struct {
+	Name    string
+	KeyHash string
+	Role    string
+}
+
+type user struct {
+	passwordHash []byte
+	role         Role
+}
+
+type apiKey struct {
+	name string
+	hash []byte
+	role Role
+}
+
+type session struct {
+	username string
+	role     Role
+	expires  time.Time
+}
+
+// Authenticator checks credentials on every request. Sessions live in
+// memory, so restarting gocam logs everyone out.
+type Authenticator struct {
+	enabled        bool
+	sessionTTL     time.Duration
+	users          map[string]user
+	apiKeys        []apiKey
+	allowedOrigins []string
+	// dummyHash is compared against for unknown usernames so that login
+	// takes as long as for real ones
+	dummyHash []byte
+	// urlKey signs links that work without credentials for urlTTL, such
+	// as webhook snapshot URLs; it is made at startup, so restarting gocam
+	// invalidates them
+	urlKey []byte
+	urlTTL time.Duration
+
+	mut      sync.Mutex
+	sessions map[string]session
+}
+
+func loadAuthenticator() (*Authenticator, error) {
+	auth := &Authenticator{
+		sessionTTL:     viper.GetDuration("auth.sessionTTL"),
+		urlTTL:         viper.GetDuration("auth.signedURLTTL"),
+		users:          map[string]user{},
+		allowedOrigins: viper.GetStringSlice("auth.allowedOrigins"),
+		sessions:       map[string]session{},
+	}
+
+	users := []UserConfig{}
+	if err := viper.UnmarshalKey("auth.users", &users); err != nil {
+		return nil, err
+	}
+	for i, u := range users {
+		role, err := parseRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("auth.users[%d]: %v", i, err)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("auth.users[%d]: passwordHash is not a bcrypt hash", i)
+		}
+		auth.users[u.Username] = user{[]byte(u.PasswordHash), role}
+	}
+
+	keys := []APIKeyConfig{}
+	if err := viper.UnmarshalKey("auth.apiKeys", &keys); err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		role, err := parseRole(k.Role)
+		if err != nil {
+			return nil, fmt.Errorf("auth.apiKeys[%d]: %v", i, err)
+		}
+		hash, err := hex.DecodeString(k.KeyHash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("auth.apiKeys[%d]: keyHash must be a hex SHA-256", i)
+		}
+		auth.apiKeys = append(auth.apiKeys, apiKey{k.Name, hash, role})
+	}
+
+	// Auth is on whenever credentials exist, unless explicitly disabled
+	auth.enabled = len(auth.users)+len(auth.apiKeys) > 0
+	if viper.IsSet("auth.enabled") {
+		auth.enabled = viper.GetBool("auth.enabled")
+	}
+	if auth.enabled && len(auth.users)+len(auth.apiKeys) == 0 {
+		return nil, fmt.Errorf("auth.enabled is set but no users or apiKeys are configured")
+	}
+	if !auth.enabled {
+		log.Println("[WARN]: Authentication disabled; anyone on the network can control GoCam.")
+		return auth, nil
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("gocam"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	auth.dummyHash = dummyHash
+
+	urlKey, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	auth.urlKey = []byte(urlKey)
+	return auth, nil
+}
+
+// roleFor identifies the caller from a session cookie, a bearer session
+// token, an X-API-Key header or a signed URL.
+func (a *Authenticator) roleFor(request *http.Request) Role {
+	if query := request.URL.Query(); query.Get("sig") != "" && request.Method == http.MethodGet &&
+		a.validSignature(request.URL.Path, query.Get("expires"), query.Get("sig")) {
+		return RoleViewer
+	}
+
+	if key := request.Header.Get("X-API-Key"); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		for _, k := range a.apiKeys {
+			if subtle.ConstantTimeCompare(sum[:], k.hash) == 1 {
+				return k.role
+			}
+		}
+		return RoleNone
+	}
+
+	token := ""
+	if h := request.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	} else if c, err := request.Cookie(sessionCookie); err == nil {
+		token = c.Value
+	}
+	if token == "" {
+		return RoleNone
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	s, ok := a.sessions[token]
+	if !ok {
+		return RoleNone
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, token)
+		return RoleNone
+	}
+	return s.role
+}
+
+// signedQuery returns the query string, with its leading ?, that lets a GET
+// of path through as a viewer for auth.signedURLTTL. It is empty when
+// authentication is off.
+func (a *Authenticator) signedQuery(path string) string {
+	if !a.enabled {
+		return ""
+	}
+	expires := strconv.FormatInt(time.Now().Add(a.urlTTL).Unix(), 10)
+	return "?expires=" + expires + "&sig=" + a.signature(path, expires)
+}
+
+func (a *Authenticator) validSignature(path, expires, sig string) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(a.signature(path, expires)))
+}
+
+func (a *Authenticator) signature(path, expires string) string {
+	mac := hmac.New(sha256.New, a.urlKey)
+	mac.Write([]byte(path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorize writes a 401 or 403 and returns false unless the caller has at
+// least the given role. CORS preflight requests are always let through.
+func (a *Authenticator) authorize(w http.ResponseWriter, request *http.Request, role Role) bool {
+	if !a.enabled || request.Method == http.MethodOptions {
+		return true
+	}
+
+	got := a.roleFor(request)
+	if got == RoleNone {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gocam"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return false
+	}
+	if got < role {
+		http.Error(w, role.String()+" role required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireRole wraps a handler so it only runs for callers with the given role.
+func requireRole(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		setupResponse(&w, request)
+		if request.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if authenticator.authorize(w, request, role) {
+			handler(w, request)
+		}
+	}
+}
+
+func (a *Authenticator) login(username, password string) (string, session, error) {
+	u, ok := a.users[username]
+	if !ok {
+		// Spend the same time as a real check so usernames cannot be probed
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return "", session{}, fmt.Errorf("invalid username or password")
+	}
+	if bcrypt.CompareHashAndPassword(u.passwordHash, []byte(password)) != nil {
+		return "", session{}, fmt.Errorf("invalid username or password")
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", session{}, err
+	}
+	s := session{username, u.role, time.Now().Add(a.sessionTTL)}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.sessions[token] = s
+
+	// Expired sessions are otherwise only dropped when presented again
+	for t, old := range a.sessions {
+		if time.Now().After(old.expires) {
+			delete(a.sessions, t)
+		}
+	}
+	return token, s, nil
+}
+
+func (a *Authenticator) logout(request *http.Request) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if h := request.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		delete(a.sessions, strings.TrimPrefix(h, "Bearer "))
+	}
+	if c, err := request.Cookie(sessionCookie); err == nil {
+		delete(a.sessions, c.Value)
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type LoginRequest struct {
+	Username string
+	Password string
+}
+
+type LoginResponse struct {
+	Token   string
+	Role    string
+	Expires time.Time
+}
+
+// LoginHandler exchanges a username and password for a session token:
+// POST /api/login {"Username": "...", "Password": "..."}. The token is
+// returned in the body for API clients and set as a cookie for browsers.
+func LoginHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	if request.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if request.Method != http.MethodPost {
+		http.Error(w, "use POST to log in", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creds LoginRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, request.Body, 4096)).Decode(&creds); err != nil {
+		http.Error(w, "invalid login request", http.StatusBadRequest)
+		return
+	}
+
+	token, s, err := authenticator.login(creds.Username, creds.Password)
+	if err != nil {
+		log.Printf("[WARN]: Failed login for %q from %v\n", creds.Username, request.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	log.Printf("[INFO]: %v logged in from %v\n", s.username, request.RemoteAddr)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  s.expires,
+		HttpOnly: true,
+		Secure:   request.TLS != nil,
+		// Other sites must not be able to use the session, e.g. by linking
+		// to /api/power/off
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, LoginResponse{token, s.role.String(), s.expires})
+}
+
+// LogoutHandler ends the caller's session: POST /api/logout
+func LogoutHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	if request.Method != http.MethodPost {
+		http.Error(w, "use POST to log out", http.StatusMethodNotAllowed)
+		return
+	}
+	authenticator.logout(request)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hashPasswordCommand implements `gocam -hash-password`, reading a password
+// from stdin and printing the bcrypt hash for auth.users.
+func hashPasswordCommand() error {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+// genAPIKeyCommand implements `gocam -gen-api-key`, printing a new key and
+// the keyHash to put in auth.apiKeys.
+func genAPIKeyCommand() error {
+	key, err := randomToken()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(key))
+	fmt.Printf("key:     %s\nkeyHash: %s\n", key, hex.EncodeToString(sum[:]))
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuthenticator has an admin alice, a viewer bob, and an API key per
+// role. Passwords are the username followed by "-password".
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	a := &Authenticator{enabled: true, sessionTTL: time.Hour, users: map[string]user{}, sessions: map[string]session{}}
+	for name, role := range map[string]Role{"alice": RoleAdmin, "bob": RoleViewer} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(name+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.users[name] = user{hash, role}
+	}
+	for key, role := range map[string]Role{"admin-key": RoleAdmin, "viewer-key": RoleViewer} {
+		sum := sha256.Sum256([]byte(key))
+		a.apiKeys = append(a.apiKeys, apiKey{key, sum[:], role})
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("gocam"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dummyHash = dummyHash
+	a.urlKey, a.urlTTL = []byte("url-key"), time.Hour
+	return a
+}
+
+// useAuthenticator installs a as the global authenticator for one test.
+func useAuthenticator(t *testing.T, a *Authenticator) {
+	previous := authenticator
+	authenticator = a
+	t.Cleanup(func() { authenticator = previous })
+}
+
+// newTestCamera is a powered-off camera with an empty archive and nothing
+// to capture from.
+func newTestCamera(t *testing.T, id string) *Camera {
+	t.Helper()
+	store, err := openArchiveStore(filepath.Join(t.TempDir(), id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Camera{
+		ID:         id,
+		Name:       id,
+		archive:    store,
+		recorder:   newEventRecorder(id, store, 20, 0, 0, 0),
+		connection: ConnectionState{Connected: true},
+		metrics:    newCameraMetrics(),
+		masks:      &MaskSet{camera: id},
+	}
+}
+
+// useCameras registers cams, the first being the primary camera, for one test.
+func useCameras(t *testing.T, cams ...*Camera) {
+	previous, previousByID := cameras, camerasByID
+	cameras, camerasByID = cams, map[string]*Camera{}
+	for _, cam := range cams {
+		camerasByID[cam.ID] = cam
+	}
+	t.Cleanup(func() { cameras, camerasByID = previous, previousByID })
+}
+
+func TestAuthorize(t *testing.T) {
+	a := newTestAuthenticator(t)
+	now := time.Now()
+	a.sessions["viewer-token"] = session{"bob", RoleViewer, now.Add(time.Hour)}
+	a.sessions["admin-token"] = session{"alice", RoleAdmin, now.Add(time.Hour)}
+	a.sessions["expired-token"] = session{"alice", RoleAdmin, now.Add(-time.Second)}
+
+	tests := []struct {
+		name   string
+		method string
+		// apiKey, bearer and cookie are sent when set
+		apiKey, bearer, cookie string
+		role                   Role
+		want                   int
+	}{
+		{"no credentials", "GET", "", "", "", RoleViewer, http.StatusUnauthorized},
+		{"viewer session", "GET", "", "", "viewer-token", RoleViewer, http.StatusOK},
+		{"viewer session on an admin route", "POST", "", "", "viewer-token", RoleAdmin, http.StatusForbidden},
+		{"admin session", "POST", "", "", "admin-token", RoleAdmin, http.StatusOK},
+		{"bearer token", "POST", "", "admin-token", "", RoleAdmin, http.StatusOK},
+		{"unknown session", "GET", "", "forged-token", "", RoleViewer, http.StatusUnauthorized},
+		{"expired session", "GET", "", "", "expired-token", RoleViewer, http.StatusUnauthorized},
+		{"admin key", "DELETE", "admin-key", "", "", RoleAdmin, http.StatusOK},
+		{"viewer key on an admin route", "DELETE", "viewer-key", "", "", RoleAdmin, http.StatusForbidden},
+		{"wrong key", "GET", "wrong-key", "", "", RoleViewer, http.StatusUnauthorized},
+		// A key that is sent decides on its own, whatever else comes along
+		{"wrong key with a session", "GET", "wrong-key", "", "admin-token", RoleViewer, http.StatusUnauthorized},
+		{"preflight", "OPTIONS", "", "", "", RoleAdmin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "/api/power/off", nil)
+			if tt.apiKey != "" {
+				request.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if tt.bearer != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.cookie != "" {
+				request.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+			}
+
+			w := httptest.NewRecorder()
+			ok := a.authorize(w, request, tt.role)
+			if ok != (tt.want == http.StatusOK) || w.Code != tt.want {
+				t.Errorf("authorize() = %v with status %d, want status %d", ok, w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+
+	if _, ok := a.sessions["expired-token"]; ok {
+		t.Errorf("expired session kept after it was presented")
+	}
+}
+
+func TestAuthorizeSignedURL(t *testing.T) {
+	a := newTestAuthenticator(t)
+	path := "/archives/front/SNAP_face 1.jpg"
+	query := a.signedQuery(path)
+	a.urlTTL = -time.Second
+	expired := a.signedQuery(path)
+
+	tests := []struct {
+		name, method, url string
+		role              Role
+		want              int
+	}{
+		{"signed", "GET", "/archives/front/SNAP_face%201.jpg" + query, RoleViewer, http.StatusOK},
+		{"another file", "GET", "/archives/front/SNAP_face%202.jpg" + query, RoleViewer, http.StatusUnauthorized},
+		{"expired", "GET", "/archives/front/SNAP_face%201.jpg" + expired, RoleViewer, http.StatusUnauthorized},
+		{"not a GET", "DELETE", "/archives/front/SNAP_face%201.jpg" + query, RoleViewer, http.StatusUnauthorized},
+		{"admin route", "GET", "/archives/front/SNAP_face%201.jpg" + query, RoleAdmin, http.StatusForbidden},
+		{"forged", "GET", "/archives/front/SNAP_face%201.jpg?expires=9999999999&sig=00", RoleViewer, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		a.authorize(w, httptest.NewRequest(tt.method, tt.url, nil), tt.role)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	if q := (&Authenticator{}).signedQuery(path); q != "" {
+		t.Errorf("signedQuery() = %q with authentication disabled, want none", q)
+	}
+}
+
+func TestAuthorizeDisabled(t *testing.T) {
+	a := &Authenticator{}
+	request := httptest.NewRequest("POST", "/api/power/off", nil)
+	if w := httptest.NewRecorder(); !a.authorize(w, request, RoleAdmin) {
+		t.Errorf("authorize() refused a request with authentication disabled: %d", w.Code)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		username, password string
+		// want is the role logged in as, or RoleNone for a failed login
+		want Role
+	}{
+		{"alice", "alice-password", RoleAdmin},
+		{"bob", "bob-password", RoleViewer},
+		{"alice", "bob-password", RoleNone},
+		{"alice", "", RoleNone},
+		{"carol", "carol-password", RoleNone},
+	}
+	for _, tt := range tests {
+		a := newTestAuthenticator(t)
+		token, s, err := a.login(tt.username, tt.password)
+		if tt.want == RoleNone {
+			if err == nil || token != "" {
+				t.Errorf("login(%v, %v) succeeded, want an error", tt.username, tt.password)
+			}
+			if len(a.sessions) != 0 {
+				t.Errorf("failed login for %v created a session", tt.username)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("login(%v, %v) = %v", tt.username, tt.password, err)
+			continue
+		}
+		if s.role != tt.want || s.username != tt.username {
+			t.Errorf("login(%v) = %v as %v, want %v", tt.username, s.username, s.role, tt.want)
+		}
+		if d := time.Until(s.expires); d <= 59*time.Minute || d > time.Hour {
+			t.Errorf("session for %v expires in %v, want the 1h TTL", tt.username, d)
+		}
+
+		request := httptest.NewRequest("GET", "/api/status", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		if got := a.roleFor(request); got != tt.want {
+			t.Errorf("session token of %v gives role %v, want %v", tt.username, got, tt.want)
+		}
+		a.logout(request)
+		if got := a.roleFor(request); got != RoleNone {
+			t.Errorf("session token of %v still gives %v after logout", tt.username, got)
+		}
+	}
+}
+
+func TestLoginDropsExpiredSessions(t *testing.T) {
+	a := newTestAuthenticator(t)
+	a.sessions["expired-token"] = session{"bob", RoleViewer, time.Now().Add(-time.Minute)}
+	if _, _, err := a.login("alice", "alice-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.sessions["expired-token"]; ok || len(a.sessions) != 1 {
+		t.Errorf("sessions after login = %v, want only the new one", a.sessions)
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	useAuthenticator(t, newTestAuthenticator(t))
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"valid", "POST", `{"Username": "bob", "Password": "bob-password"}`, http.StatusOK},
+		{"wrong password", "POST", `{"Username": "bob", "Password": "alice-password"}`, http.StatusUnauthorized},
+		{"not JSON", "POST", `bob:bob-password`, http.StatusBadRequest},
+		{"GET", "GET", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		LoginHandler(w, httptest.NewRequest(tt.method, "/api/login", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		cookies := w.Result().Cookies()
+		if tt.want != http.StatusOK {
+			if len(cookies) != 0 {
+				t.Errorf("%v: set cookies %v", tt.name, cookies)
+			}
+			continue
+		}
+		if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+			t.Errorf("%v: cookies %v, want an HttpOnly, SameSite=Strict session cookie", tt.name, cookies)
+		}
+	}
+}
+
+func TestLoadAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("key"))
+	users := []map[string]interface{}{{"username": "alice", "passwordHash": string(hash), "role": "admin"}}
+	keys := []map[string]interface{}{{"name": "nvr", "keyHash": hex.EncodeToString(sum[:]), "role": "viewer"}}
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		// enabled is ignored when an error is expected
+		enabled bool
+		wantErr bool
+	}{
+		{"no credentials turns auth off", nil, false, false},
+		{"users turn auth on", map[string]interface{}{"auth.users": users}, true, false},
+		{"api keys turn auth on", map[string]interface{}{"auth.apiKeys": keys}, true, false},
+		{"explicitly off", map[string]interface{}{"auth.users": users, "auth.enabled": false}, false, false},
+		{"on without credentials", map[string]interface{}{"auth.enabled": true}, false, true},
+		{"unknown role", map[string]interface{}{"auth.users": []map[string]interface{}{{"username": "alice", "passwordHash": string(hash), "role": "root"}}}, false, true},
+		{"plain password", map[string]interface{}{"auth.users": []map[string]interface{}{{"username": "alice", "passwordHash": "pw", "role": "admin"}}}, false, true},
+		{"short key hash", map[string]interface{}{"auth.apiKeys": []map[string]interface{}{{"name": "nvr", "keyHash": "abcd", "role": "admin"}}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+			for key, value := range tt.settings {
+				viper.Set(key, value)
+			}
+
+			a, err := loadAuthenticator()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("loadAuthenticator() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.enabled != tt.enabled {
+				t.Errorf("enabled = %v, want %v", a.enabled, tt.enabled)
+			}
+			request := httptest.NewRequest("POST", "/api/power/off", nil)
+			if w := httptest.NewRecorder(); a.authorize(w, request, RoleAdmin) == tt.enabled {
+				t.Errorf("anonymous admin request allowed = %v with auth enabled = %v", !tt.enabled, tt.enabled)
+			}
+		})
+	}
+}
+
+// TestAdminRoutes sends viewer and admin requests through the handlers as
+// main wires them up.
+func TestAdminRoutes(t *testing.T) {
+	a := newTestAuthenticator(t)
+	a.sessions["viewer-token"] = session{"bob", RoleViewer, time.Now().Add(time.Hour)}
+	a.sessions["admin-token"] = session{"alice", RoleAdmin, time.Now().Add(time.Hour)}
+	useAuthenticator(t, a)
+	cam := newTestCamera(t, "front")
+	useCameras(t, cam)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		handler http.HandlerFunc
+		// viewer and admin are the statuses each role gets
+		viewer, admin int
+	}{
+		{"power off", "POST", "/api/power/off", requireRole(RoleAdmin, PowerOffHandler), http.StatusForbidden, http.StatusOK},
+		{"power on", "POST", "/api/cameras/front/power/on", requireRole(RoleViewer, CameraHandler), http.StatusForbidden, http.StatusOK},
+		{"power by GET", "GET", "/api/power/off", requireRole(RoleAdmin, PowerOffHandler), http.StatusForbidden, http.StatusMethodNotAllowed},
+		{"power state", "GET", "/api/power", requireRole(RoleViewer, GetPowerHandler), http.StatusOK, http.StatusOK},
+		{"record", "POST", "/api/cameras/front/record", requireRole(RoleViewer, CameraHandler), http.StatusForbidden, http.StatusConflict},
+		{"delete archive", "DELETE", "/api/archives/TMP_missing.avi", requireRole(RoleViewer, ArchiveHandler), http.StatusForbidden, http.StatusNotFound},
+		{"delete camera archive", "DELETE", "/api/cameras/front/archives/TMP_missing.avi", requireRole(RoleViewer, CameraHandler), http.StatusForbidden, http.StatusNotFound},
+		{"archive info", "GET", "/api/archives/TMP_missing.avi", requireRole(RoleViewer, ArchiveHandler), http.StatusNotFound, http.StatusNotFound},
+		{"change mode", "PUT", "/api/mode", requireRole(RoleViewer, ModeHandler), http.StatusForbidden, http.StatusBadRequest},
+		{"add mask", "POST", "/api/masks", requireRole(RoleViewer, MasksHandler), http.StatusForbidden, http.StatusBadRequest},
+		{"delete mask", "DELETE", "/api/cameras/front/masks/window", requireRole(RoleViewer, CameraHandler), http.StatusForbidden, http.StatusNotFound},
+		{"list masks", "GET", "/api/masks", requireRole(RoleViewer, MasksHandler), http.StatusOK, http.StatusOK},
+		{"save snapshot", "POST", "/api/snapshot", requireRole(RoleViewer, SnapshotHandler), http.StatusForbidden, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		for _, caller := range []struct {
+			token string
+			want  int
+		}{{"viewer-token", tt.viewer}, {"admin-token", tt.admin}} {
+			cam.SetRunning(false)
+			request := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			request.AddCookie(&http.Cookie{Name: sessionCookie, Value: caller.token})
+			w := httptest.NewRecorder()
+			tt.handler(w, request)
+			if w.Code != caller.want {
+				t.Errorf("%v by %v: status %d, want %d", tt.name, caller.token, w.Code, caller.want)
+			}
+			if w.Code == http.StatusForbidden && cam.IsRunning() {
+				t.Errorf("%v by %v: forbidden request changed the power state", tt.name, caller.token)
+			}
+		}
+	}
+}
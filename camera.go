@@ -0,0 +1,916 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hybridgroup/mjpeg"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"gocv.io/x/gocv"
+)
+
+// CameraConfig is one entry of the cameras: list. Keys left out of an entry
+// fall back to the top-level settings of the same name.
+//
+// RecordMode is "continuous" (fixed-length TMP_ clips) or "motion" (no
+// continuous recording; motion starts EVT_ clips).
+type CameraConfig struct {
+	ID                  string
+	Name                string
+	Source              string
+	FacialDetectionFile string
+	TempRecLength       time.Duration
+	RecordMode          string
+	Motion              MotionConfig
+	Events              EventConfig
+	Reconnect           ReconnectConfig
+	Masks               []PrivacyMask
+	Zones               []DetectionZone
+	Overlay             OverlayConfig
+	Detectors           []CascadeConfig
+	DNN                 DNNConfig
+	Tracking            TrackingConfig
+	Lines               []LineConfig
+	Loitering           []LoiterRule
+	Saturation          float64
+	FPS                 float64
+	Brightness          float64
+	Contrast            float64
+}
+
+// Camera owns everything needed to run one capture pipeline: its frame
+// source, the latest frame, detector, mjpeg stream and archive folder.
+type Camera struct {
+	ID     string
+	Name   string
+	config CameraConfig
+
+	source FrameSource
+	stream *mjpeg.Stream
+
+	// img is the latest frame with detections drawn on it; raw is the
+	// same frame as captured. Both are released once closed is set. frames
+	// counts the frames captured so far.
+	img    gocv.Mat
+	raw    gocv.Mat
+	frames uint64
+	closed bool
+	mut    sync.Mutex
+
+	detectors []Detector
+
+	// runMut guards the power and connection state
+	isRunning  bool
+	sourceName string
+	connection ConnectionState
+	tempFile   string
+	runMut     sync.Mutex
+
+	motion      *MotionDetector
+	recorder    *EventRecorder
+	manualUntil time.Time
+	lastEvent   map[string]time.Time
+
+	writeMut sync.Mutex
+	archive  *ArchiveStore
+
+	metrics *CameraMetrics
+	masks   *MaskSet
+	zones   *ZoneSet
+	overlay *Overlay
+	tracker *Tracker
+	lines   *LineSet
+	loiter  *LoiterSet
+
+	// wg tracks the loops started by Start so Close can wait for them
+	wg sync.WaitGroup
+}
+
+var (
+	cameras     []*Camera
+	camerasByID = map[string]*Camera{}
+)
+
+// loadCameraConfigs reads the cameras: list, or builds a single camera from
+// the top-level settings when the list is absent.
+func loadCameraConfigs() ([]CameraConfig, error) {
+	tempRecLength, _ := time.ParseDuration(viper.GetString("tempRecLength"))
+	base := CameraConfig{
+		ID:                  "default",
+		Source:              viper.GetString("source"),
+		FacialDetectionFile: viper.GetString("facialDetectionFile"),
+		TempRecLength:       tempRecLength,
+		RecordMode:          viper.GetString("recordMode"),
+		Motion: MotionConfig{
+			Method:      viper.GetString("motion.method"),
+			Sensitivity: viper.GetFloat64("motion.sensitivity"),
+			MinArea:     viper.GetFloat64("motion.minArea"),
+		},
+		Events: EventConfig{
+			Triggers:     viper.GetStringSlice("events.triggers"),
+			PreRoll:      viper.GetDuration("events.preRoll"),
+			PostRoll:     viper.GetDuration("events.postRoll"),
+			BufferMemory: viper.GetString("events.bufferMemory"),
+			Cooldown:     viper.GetDuration("events.cooldown"),
+			Snapshots:    viper.GetBool("events.snapshots"),
+		},
+		Reconnect: ReconnectConfig{
+			InitialBackoff: viper.GetDuration("reconnect.initialBackoff"),
+			MaxBackoff:     viper.GetDuration("reconnect.maxBackoff"),
+		},
+		Overlay: OverlayConfig{
+			Timestamp:       viper.GetBool("overlay.timestamp"),
+			TimestampFormat: viper.GetString("overlay.timestampFormat"),
+			CameraName:      viper.GetBool("overlay.cameraName"),
+			Text:            viper.GetString("overlay.text"),
+			Position:        viper.GetString("overlay.position"),
+			Scale:           viper.GetFloat64("overlay.scale"),
+			Boxes:           viper.GetBool("overlay.boxes"),
+			Colors:          viper.GetStringMapString("overlay.colors"),
+		},
+		DNN: DNNConfig{
+			Model:       viper.GetString("dnn.model"),
+			Config:      viper.GetString("dnn.config"),
+			ClassesFile: viper.GetString("dnn.classesFile"),
+			Classes:     viper.GetStringSlice("dnn.classes"),
+			Confidence:  viper.GetFloat64("dnn.confidence"),
+			NMS:         viper.GetFloat64("dnn.nms"),
+			InputWidth:  viper.GetInt("dnn.inputWidth"),
+			InputHeight: viper.GetInt("dnn.inputHeight"),
+			Scale:       viper.GetFloat64("dnn.scale"),
+			SwapRB:      viper.GetBool("dnn.swapRB"),
+			Output:      viper.GetString("dnn.output"),
+		},
+		Tracking: TrackingConfig{
+			Enabled:     viper.GetBool("tracking.enabled"),
+			MinIoU:      viper.GetFloat64("tracking.minIoU"),
+			MaxDistance: viper.GetFloat64("tracking.maxDistance"),
+			MinHits:     viper.GetInt("tracking.minHits"),
+			MaxAge:      viper.GetDuration("tracking.maxAge"),
+			MaxPath:     viper.GetInt("tracking.maxPath"),
+		},
+		Saturation: viper.GetFloat64("saturation"),
+		FPS:        viper.GetFloat64("fps"),
+		Brightness: viper.GetFloat64("brightness"),
+		Contrast:   viper.GetFloat64("contrast"),
+	}
+	if base.RecordMode != "continuous" && base.RecordMode != "motion" {
+		return nil, fmt.Errorf("unknown recordMode %q", base.RecordMode)
+	}
+	// Pre/post-roll used to live under motion:. They have no viper default
+	// (IsSet is true for defaults too), so 5s and 10s are applied here.
+	if !viper.IsSet("events.preRoll") {
+		base.Events.PreRoll = 5 * time.Second
+		if viper.IsSet("motion.preRoll") {
+			base.Events.PreRoll = viper.GetDuration("motion.preRoll")
+		}
+	}
+	if !viper.IsSet("events.postRoll") {
+		base.Events.PostRoll = 10 * time.Second
+		if viper.IsSet("motion.postRoll") {
+			base.Events.PostRoll = viper.GetDuration("motion.postRoll")
+		}
+	}
+	if _, err := parseByteSize(base.Events.BufferMemory); err != nil {
+		return nil, fmt.Errorf("events.bufferMemory: %v", err)
+	}
+	if base.Reconnect.InitialBackoff <= 0 || base.Reconnect.MaxBackoff < base.Reconnect.InitialBackoff {
+		return nil, fmt.Errorf("reconnect.initialBackoff must be positive and no more than reconnect.maxBackoff")
+	}
+	if err := viper.UnmarshalKey("masks", &base.Masks); err != nil {
+		return nil, fmt.Errorf("masks: %v", err)
+	}
+	if err := viper.UnmarshalKey("zones", &base.Zones); err != nil {
+		return nil, fmt.Errorf("zones: %v", err)
+	}
+	if err := viper.UnmarshalKey("detectors", &base.Detectors); err != nil {
+		return nil, fmt.Errorf("detectors: %v", err)
+	}
+	if err := viper.UnmarshalKey("lines", &base.Lines); err != nil {
+		return nil, fmt.Errorf("lines: %v", err)
+	}
+	if err := viper.UnmarshalKey("loitering", &base.Loitering); err != nil {
+		return nil, fmt.Errorf("loitering: %v", err)
+	}
+	if err := mapstructure.WeakDecode(viper.Get("dnn.mean"), &base.DNN.Mean); err != nil {
+		return nil, fmt.Errorf("dnn.mean: %v", err)
+	}
+	if base.Source == "" {
+		log.Println("[WARN]: captureDevice is deprecated; use source: \"device:N\" instead.")
+		base.Source = "device:" + viper.GetString("captureDevice")
+	}
+
+	entries, ok := viper.Get("cameras").([]interface{})
+	if !ok || len(entries) == 0 {
+		base.Name = base.ID
+		return []CameraConfig{base}, nil
+	}
+
+	configs := []CameraConfig{}
+	seen := map[string]bool{}
+	for i, entry := range entries {
+		cfg := base
+		cfg.ID = ""
+		// Decoding into a filled slice would merge element by element, so a
+		// camera's lists replace the top-level ones rather than patch them
+		cfg.Masks = nil
+		cfg.Zones = nil
+		cfg.Detectors = nil
+		cfg.Lines = nil
+		cfg.Loitering = nil
+		cfg.DNN.Classes = nil
+		cfg.DNN.Mean = nil
+		cfg.Events.Triggers = nil
+		// Maps decode in place, so each camera adds its colours to its own copy
+		cfg.Overlay.Colors = map[string]string{}
+		for label, hex := range base.Overlay.Colors {
+			cfg.Overlay.Colors[label] = hex
+		}
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			WeaklyTypedInput: true,
+			DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+			Result:           &cfg,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := decoder.Decode(entry); err != nil {
+			return nil, fmt.Errorf("cameras[%d]: %v", i, err)
+		}
+
+		if cfg.ID == "" {
+			cfg.ID = fmt.Sprintf("cam%d", i)
+		}
+		if cfg.Masks == nil {
+			cfg.Masks = base.Masks
+		}
+		if cfg.Zones == nil {
+			cfg.Zones = base.Zones
+		}
+		if cfg.Detectors == nil {
+			cfg.Detectors = base.Detectors
+		}
+		if cfg.Lines == nil {
+			cfg.Lines = base.Lines
+		}
+		if cfg.Loitering == nil {
+			cfg.Loitering = base.Loitering
+		}
+		if cfg.DNN.Classes == nil {
+			cfg.DNN.Classes = base.DNN.Classes
+		}
+		if cfg.DNN.Mean == nil {
+			cfg.DNN.Mean = base.DNN.Mean
+		}
+		if cfg.Events.Triggers == nil {
+			cfg.Events.Triggers = base.Events.Triggers
+		}
+		if !validCameraID(cfg.ID) {
+			return nil, fmt.Errorf("cameras[%d]: invalid id %q", i, cfg.ID)
+		}
+		if cfg.RecordMode != "continuous" && cfg.RecordMode != "motion" {
+			return nil, fmt.Errorf("cameras[%d]: unknown recordMode %q", i, cfg.RecordMode)
+		}
+		if _, err := parseByteSize(cfg.Events.BufferMemory); err != nil {
+			return nil, fmt.Errorf("cameras[%d]: events.bufferMemory: %v", i, err)
+		}
+		if cfg.Reconnect.InitialBackoff <= 0 || cfg.Reconnect.MaxBackoff < cfg.Reconnect.InitialBackoff {
+			return nil, fmt.Errorf("cameras[%d]: reconnect.initialBackoff must be positive and no more than reconnect.maxBackoff", i)
+		}
+		if seen[cfg.ID] {
+			return nil, fmt.Errorf("cameras[%d]: duplicate id %q", i, cfg.ID)
+		}
+		seen[cfg.ID] = true
+		if cfg.Name == "" {
+			cfg.Name = cfg.ID
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// validCameraID keeps ids safe for use in URLs and as directory names.
+func validCameraID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func newCamera(cfg CameraConfig) (*Camera, error) {
+	cam := &Camera{
+		ID:        cfg.ID,
+		Name:      cfg.Name,
+		config:    cfg,
+		isRunning: true,
+		lastEvent: map[string]time.Time{},
+		metrics:   newCameraMetrics(),
+	}
+
+	archive, err := openArchiveStore(filepath.Join(archiveRoot, cfg.ID))
+	if err != nil {
+		return nil, err
+	}
+	cam.archive = archive
+
+	// Privacy masks are applied to every frame as soon as it is read
+	masks, err := newMaskSet(cfg.ID, cfg.Masks, state.Get().Masks[cfg.ID])
+	if err != nil {
+		return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+	}
+	cam.masks = masks
+
+	zones, err := newZoneSet(cfg.Zones)
+	if err != nil {
+		return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+	}
+	cam.zones = zones
+
+	overlay, err := newOverlay(cfg.Overlay, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+	}
+	cam.overlay = overlay
+
+	// Tracks turn per-frame detections into visits with stable IDs
+	if cfg.Tracking.Enabled {
+		if err := cfg.Tracking.validate(); err != nil {
+			return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+		}
+		cam.tracker = newTracker(cfg.Tracking)
+	}
+	lines, err := newLineSet(cfg.Lines)
+	if err != nil {
+		return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+	}
+	if len(cfg.Lines) > 0 && cam.tracker == nil {
+		return nil, fmt.Errorf("camera %v: lines need tracking.enabled", cfg.ID)
+	}
+	cam.lines = lines
+	loiter, err := newLoiterSet(cfg.Loitering, cam.zones)
+	if err != nil {
+		return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+	}
+	if len(cfg.Loitering) > 0 && cam.tracker == nil {
+		return nil, fmt.Errorf("camera %v: loitering needs tracking.enabled", cfg.ID)
+	}
+	cam.loiter = loiter
+
+	// Open the frame source. A camera that is missing at boot starts
+	// offline and Start keeps trying to reconnect it.
+	source, err := openFrameSource(cfg.Source)
+	if err != nil {
+		log.Printf("[WARN]: [%v] Unable to open frame source %v: %v\n", cam.ID, redactSource(cfg.Source), err)
+		cam.sourceName = redactSource(cfg.Source)
+		cam.connection = ConnectionState{Since: time.Now(), LastError: err.Error()}
+	} else {
+		cam.source = source
+		cam.sourceName = source.String()
+		cam.connection = ConnectionState{Connected: true, Since: time.Now()}
+
+		// Video capture settings
+		if device, ok := source.(*deviceSource); ok {
+			device.Configure(cfg.Saturation, cfg.FPS, cfg.Brightness, cfg.Contrast)
+		}
+		log.Printf("[%v] Frame source configured: %v\n", cam.ID, source)
+	}
+
+	// Load the cascades; facialDetectionFile is shorthand for a single
+	// face cascade when no detectors are listed
+	cascades := cfg.Detectors
+	if len(cascades) == 0 && cfg.FacialDetectionFile != "" {
+		cascades = []CascadeConfig{{Label: "face", File: cfg.FacialDetectionFile}}
+	}
+	seen := map[string]bool{}
+	for _, cascade := range cascades {
+		if !cascade.enabled() {
+			log.Printf("[INFO]: [%v] Detector %v is disabled.\n", cam.ID, cascade.File)
+			continue
+		}
+		d, err := newCascadeDetector(cascade)
+		if err == nil && seen[d.Name()] {
+			d.Close()
+			err = fmt.Errorf("detector %v already exists", d.Name())
+		}
+		if err != nil {
+			cam.closeDetectors()
+			cam.closeSource()
+			return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+		}
+		seen[d.Name()] = true
+		cam.detectors = append(cam.detectors, d)
+		if c, err := parseColor(d.config.Color); err == nil {
+			cam.overlay.SetDefaultColor(d.config.Label, c)
+		}
+	}
+	if len(cam.detectors) == 0 {
+		log.Printf("[WARN]: [%v] No facial detection data file provided; facial detection disabled.\n", cam.ID)
+	}
+
+	// Object detection with a neural network
+	if cfg.DNN.Model != "" {
+		objects, err := newDNNDetector(cfg.DNN)
+		if err != nil {
+			cam.closeDetectors()
+			cam.closeSource()
+			return nil, fmt.Errorf("camera %v: %v", cfg.ID, err)
+		}
+		cam.detectors = append(cam.detectors, objects)
+		log.Printf("[INFO]: [%v] Object detection enabled with %v.\n", cam.ID, cfg.DNN.Model)
+	}
+	for _, d := range cam.detectors {
+		cam.metrics.detectLatency[d.Name()] = newDetectLatency()
+	}
+
+	// Motion mode only writes clips while something moves
+	if cfg.RecordMode == "motion" {
+		cam.motion = newMotionDetector(cfg.Motion)
+		if !cfg.Events.triggeredBy("motion") {
+			log.Printf("[WARN]: [%v] recordMode is motion but motion is not in events.triggers; motion will not be recorded.\n", cam.ID)
+		}
+	}
+	bufferMemory, _ := parseByteSize(cfg.Events.BufferMemory)
+	cam.recorder = newEventRecorder(cam.ID, cam.archive, cfg.FPS, cfg.Events.PreRoll, cfg.Events.PostRoll, bufferMemory)
+
+	// Prepare image matrix
+	cam.img = gocv.NewMat()
+	cam.raw = gocv.NewMat()
+
+	// Create the mjpeg stream
+	cam.stream = mjpeg.NewStream()
+	cam.stream.FrameInterval = 25 * time.Millisecond
+
+	return cam, nil
+}
+
+// Start captures a first frame and then runs the capture, stream and
+// recording loops in the background until ctx is cancelled. A loop that
+// cannot continue reports its error to fail instead of exiting the process.
+// A camera that cannot deliver the first frame starts offline and
+// reconnects in the background.
+func (cam *Camera) Start(ctx context.Context, fail func(error)) {
+	// Capture a single image just to initialize the image variable
+	var offline error
+	if cam.source == nil {
+		offline = errors.New(cam.Connection().LastError)
+	} else if err := cam.captureImage(); err != nil {
+		offline = err
+		cam.setConnected(false, err)
+	}
+
+	// Capture images from the camera in parallel
+	cam.wg.Add(1)
+	go func() {
+		defer cam.wg.Done()
+		if offline != nil {
+			cam.reconnect(ctx, offline)
+		}
+		for ctx.Err() == nil {
+			if cam.IsRunning() {
+				err := cam.captureImage()
+				if err == io.EOF {
+					// Nothing more to read; keep serving archives with the camera off
+					log.Printf("[INFO]: [%v] Frame source %v exhausted; powering off.\n", cam.ID, cam.SourceName())
+					cam.SetRunning(false)
+					continue
+				} else if err != nil {
+					cam.metrics.ReadFailed()
+					cam.reconnect(ctx, err)
+					continue
+				}
+				now := time.Now()
+				cam.metrics.FrameCaptured(now)
+				triggers := cam.config.Events
+				var moving, found []Detection
+				_, mode := arming.Current()
+				detecting := scheduler.Active(cam.ID, activityDetection, now)
+				if cam.motion != nil && detecting && allows(mode.Detectors, "motion") {
+					moving = cam.detectMotion()
+				}
+				for _, d := range cam.detectors {
+					if detecting && allows(mode.Detectors, d.Name()) {
+						found = append(found, cam.runDetector(d)...)
+					}
+				}
+				var tracks TrackUpdate
+				var crossings []Crossing
+				var loitering []Loitering
+				if cam.tracker != nil {
+					tracks, crossings = cam.track(now, found)
+					loitering = cam.loiter.Check(now, cam.tracker.Active(), tracks.Ended)
+				}
+				labels, byLabel := groupByLabel(found)
+				cam.metrics.Detected("motion", len(moving))
+				for _, label := range labels {
+					cam.metrics.Detected(label, len(byLabel[label]))
+				}
+				cam.drawDetections(append(append([]Detection{}, moving...), found...))
+
+				// Objects take precedence over motion in the clip name
+				trigger := ""
+				if len(moving) > 0 && triggers.triggeredBy("motion") {
+					trigger = "motion"
+				}
+				for _, label := range labels {
+					if triggers.triggeredBy(label) {
+						trigger = label
+					}
+				}
+				if !mode.EventRecording {
+					trigger = ""
+				}
+				if len(triggers.Triggers) > 0 {
+					cam.recordEvent(now, trigger)
+				}
+
+				if len(moving) > 0 {
+					cam.raiseEvent(now, "motion", moving)
+				}
+				if cam.tracker == nil {
+					for _, label := range labels {
+						cam.raiseEvent(now, label, byLabel[label])
+					}
+				}
+				for _, track := range tracks.Started {
+					cam.raiseTrackEvent(now, track.Label, track)
+				}
+				for _, track := range tracks.Ended {
+					cam.raiseTrackEvent(now, track.Label+"_end", track)
+				}
+				for _, crossing := range crossings {
+					cam.raiseCrossingEvent(now, crossing)
+				}
+				for _, alert := range loitering {
+					cam.raiseLoiteringEvent(now, alert)
+				}
+			} else {
+				// Powered off or out of frames: check again shortly rather
+				// than spinning
+				select {
+				case <-ctx.Done():
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		}
+	}()
+
+	// Start capturing for mjpeg stream
+	cam.wg.Add(1)
+	go func() {
+		defer cam.wg.Done()
+		var encoded uint64
+		for ctx.Err() == nil {
+			// While offline reconnect keeps a placeholder on the stream instead
+			if cam.IsRunning() && cam.Connection().Connected {
+				encoded = cam.mjpegCapture(encoded)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(cam.stream.FrameInterval):
+			}
+		}
+	}()
+
+	// Output temporary files to local file system
+	if cam.config.RecordMode == "motion" {
+		log.Printf("[INFO]: [%v] Recording only while motion is detected.\n", cam.ID)
+	} else if cam.config.TempRecLength > 0 {
+		cam.wg.Add(1)
+		go func() {
+			defer cam.wg.Done()
+			for ctx.Err() == nil {
+				cam.writeMut.Lock()
+				err := cam.writeTemporaryStorage(ctx, cam.config.TempRecLength)
+				cam.writeMut.Unlock()
+				if err != nil {
+					fail(fmt.Errorf("camera %v: %v", cam.ID, err))
+					return
+				}
+			}
+		}()
+	} else {
+		log.Printf("[WARN]: [%v] temp recording length set to 0; recording will not be saved to file system.\n", cam.ID)
+	}
+}
+
+// Close waits for the loops started by Start to return, which they do once
+// their context is cancelled, then finishes any event clip and releases
+// the frame source. Requests still being served afterwards find the
+// camera unavailable.
+func (cam *Camera) Close() {
+	cam.wg.Wait()
+	cam.closeSource()
+	cam.closeDetectors()
+	cam.mut.Lock()
+	cam.recorder.Close()
+	cam.mut.Unlock()
+	if cam.motion != nil {
+		cam.motion.Close()
+	}
+	cam.mut.Lock()
+	cam.closed = true
+	cam.img.Close()
+	cam.raw.Close()
+	cam.masks.Close()
+	cam.mut.Unlock()
+}
+
+func (cam *Camera) IsRunning() bool {
+	cam.runMut.Lock()
+	defer cam.runMut.Unlock()
+	return cam.isRunning
+}
+
+func (cam *Camera) SetRunning(running bool) {
+	cam.runMut.Lock()
+	cam.isRunning = running
+	cam.runMut.Unlock()
+}
+
+// ContinuousFile is the TMP_ recording being written, if any.
+func (cam *Camera) ContinuousFile() string {
+	cam.runMut.Lock()
+	defer cam.runMut.Unlock()
+	return cam.tempFile
+}
+
+func (cam *Camera) setContinuousFile(name string) {
+	cam.runMut.Lock()
+	cam.tempFile = name
+	cam.runMut.Unlock()
+}
+
+// runDetector runs d on the latest frame and keeps the detections inside
+// the camera's zones.
+func (cam *Camera) runDetector(d Detector) []Detection {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+
+	start := time.Now()
+	detections := d.Detect(cam.raw)
+	cam.metrics.detectLatency[d.Name()].ObserveSince(start)
+	return cam.zones.Filter(detections, cam.raw.Cols(), cam.raw.Rows())
+}
+
+// track matches detections to the camera's tracks, tagging them with
+// their track IDs, and finds the tracks that crossed a line.
+func (cam *Camera) track(now time.Time, detections []Detection) (TrackUpdate, []Crossing) {
+	cam.mut.Lock()
+	cols, rows := cam.raw.Cols(), cam.raw.Rows()
+	cam.mut.Unlock()
+	update := cam.tracker.Update(now, detections, cols, rows)
+	crossings := cam.lines.Cross(update.Moved, cols, rows)
+	cam.lines.Forget(update.Ended)
+	return update, crossings
+}
+
+// closeSource releases the frame source, if one is open.
+func (cam *Camera) closeSource() {
+	if cam.source != nil {
+		cam.source.Close()
+		cam.source = nil
+	}
+}
+
+func (cam *Camera) closeDetectors() {
+	for _, d := range cam.detectors {
+		if err := d.Close(); err != nil {
+			log.Printf("[WARN]: [%v] Unable to close %v detector: %v\n", cam.ID, d.Name(), err)
+		}
+	}
+}
+
+func (cam *Camera) detectMotion() []Detection {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+
+	detections := []Detection{}
+	for _, r := range cam.motion.Detect(cam.raw) {
+		detections = append(detections, Detection{Label: "motion", Box: r})
+	}
+	return cam.zones.Filter(detections, cam.raw.Cols(), cam.raw.Rows())
+}
+
+// groupByLabel splits detections by label, listing labels in the order
+// they were first found.
+func groupByLabel(detections []Detection) ([]string, map[string][]Detection) {
+	labels := []string{}
+	byLabel := map[string][]Detection{}
+	for _, d := range detections {
+		if _, ok := byLabel[d.Label]; !ok {
+			labels = append(labels, d.Label)
+		}
+		byLabel[d.Label] = append(byLabel[d.Label], d)
+	}
+	return labels, byLabel
+}
+
+// drawDetections outlines detections on the frame that is streamed and
+// recorded.
+func (cam *Camera) drawDetections(detections []Detection) {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+
+	cam.overlay.DrawDetections(&cam.img, detections)
+}
+
+func (cam *Camera) recordEvent(now time.Time, trigger string) {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+
+	if trigger == "" && now.Before(cam.manualUntil) {
+		trigger = "manual"
+	}
+	cam.recorder.Update(cam.img, now, trigger)
+}
+
+// raiseEvent logs a detection to the event log, at most once per cooldown
+// for each kind, with a snapshot and the clip being recorded.
+func (cam *Camera) raiseEvent(now time.Time, kind string, detections []Detection) {
+	if now.Sub(cam.lastEvent[kind]) < cam.config.Events.Cooldown {
+		return
+	}
+	cam.lastEvent[kind] = now
+
+	cam.logEvent(Event{Time: now, Camera: cam.ID, Kind: kind, Detections: detections}, true)
+}
+
+// trackDetection is the detection a track's events report: its latest box.
+func trackDetection(track Track) Detection {
+	return Detection{Label: track.Label, Box: track.Box, Confidence: track.Confidence, Zone: track.Zone, Track: track.ID}
+}
+
+// raiseTrackEvent logs the start or end of a track. Every track is its own
+// visit, so there is no cooldown; only starts get a snapshot since the
+// object is gone when a track ends.
+func (cam *Camera) raiseTrackEvent(now time.Time, kind string, track Track) {
+	event := Event{Time: now, Camera: cam.ID, Kind: kind, Detections: []Detection{trackDetection(track)}, Track: &track}
+	cam.logEvent(event, !track.Ended)
+}
+
+// raiseCrossingEvent logs a tracked object crossing a line. Crossings are
+// counted, so there is no cooldown and no snapshot.
+func (cam *Camera) raiseCrossingEvent(now time.Time, crossing Crossing) {
+	track := crossing.Track
+	event := Event{Time: now, Camera: cam.ID, Kind: "crossing", Detections: []Detection{trackDetection(track)}, Track: &track,
+		Line: crossing.Line, Direction: crossing.Direction}
+	cam.logEvent(event, false)
+}
+
+// raiseLoiteringEvent logs an object staying in a zone past a loitering
+// rule's threshold, with a snapshot of who is there.
+func (cam *Camera) raiseLoiteringEvent(now time.Time, alert Loitering) {
+	track := alert.Track
+	event := Event{Time: now, Camera: cam.ID, Kind: alert.Kind, Detections: []Detection{trackDetection(track)}, Track: &track,
+		Rule: alert.Rule, Dwell: alert.Dwell.Seconds()}
+	cam.logEvent(event, true)
+}
+
+// logEvent adds the clip being recorded and optionally a snapshot to event,
+// appends it to the event log and notifies the webhooks.
+func (cam *Camera) logEvent(event Event, snapshot bool) {
+	now, kind := event.Time, event.Kind
+
+	cam.mut.Lock()
+	event.Clip = cam.recorder.CurrentClip()
+	if snapshot && cam.config.Events.Snapshots {
+		label := kind
+		if event.Track != nil {
+			// Several tracks can start within the same second
+			label = fmt.Sprintf("%v-%d", kind, event.Track.ID)
+		}
+		name := snapshotPrefix + label + "_" + now.Format(archiveTimeLayout) + ".jpg"
+		if path, err := cam.archive.Create(name); err == nil && gocv.IMWrite(path, cam.img) {
+			event.Snapshot = name
+		} else {
+			log.Printf("[ERROR]: [%v] Unable to save snapshot %v\n", cam.ID, name)
+		}
+	}
+	cam.mut.Unlock()
+
+	if err := eventLog.Append(&event); err != nil {
+		log.Printf("[ERROR]: [%v] Unable to log %v event: %v\n", cam.ID, kind, err)
+	}
+	if _, mode := arming.Current(); allows(mode.Notifications, kind) && scheduler.Active(cam.ID, activityNotifications, now) {
+		notifier.Notify(event)
+	}
+}
+
+// TriggerRecording starts (or extends) a manual event clip lasting at least d.
+func (cam *Camera) TriggerRecording(d time.Duration) time.Time {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+
+	if until := time.Now().Add(d); until.After(cam.manualUntil) {
+		cam.manualUntil = until
+	}
+	return cam.manualUntil
+}
+
+// continuousEnabled reports whether the schedule and arming mode allow
+// continuous recording right now.
+func (cam *Camera) continuousEnabled() bool {
+	_, mode := arming.Current()
+	return mode.ContinuousRecording && scheduler.Active(cam.ID, activityRecording, time.Now())
+}
+
+// prepareFrame masks a newly read frame, keeps a copy of it for the
+// detectors and burns the text overlay into the frame that is streamed and
+// recorded. The caller holds cam.mut.
+func (cam *Camera) prepareFrame() {
+	cam.masks.Apply(&cam.img)
+	cam.img.CopyTo(&cam.raw)
+	cam.overlay.DrawText(&cam.img, time.Now())
+	cam.lines.Draw(&cam.img)
+}
+
+func (cam *Camera) captureImage() error {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+
+	if err := cam.source.Read(&cam.img); err != nil {
+		return err
+	}
+	cam.prepareFrame()
+	cam.frames++
+	return nil
+}
+
+// mjpegCapture puts the latest frame on the stream unless it is frame
+// number encoded, which is already there, and returns the frame's number.
+// Frames are thus encoded at most at the capture rate.
+func (cam *Camera) mjpegCapture(encoded uint64) uint64 {
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+	if cam.frames == encoded {
+		return encoded
+	}
+	start := time.Now()
+	buf, _ := gocv.IMEncode(".jpg", cam.img)
+	cam.metrics.encodeLatency.ObserveSince(start)
+	cam.stream.UpdateJPEG(buf)
+	return cam.frames
+}
+
+// writeTemporaryStorage records one TMP_ clip of the given length, or a
+// shorter one if ctx is cancelled first. The writer is always closed so the
+// clip is playable.
+func (cam *Camera) writeTemporaryStorage(ctx context.Context, interval time.Duration) error {
+	if !cam.IsRunning() || !cam.Connection().Connected || !cam.continuousEnabled() {
+		// Check again shortly rather than spinning
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		return nil
+	}
+
+	startTime := time.Now()
+	goalTime := startTime.Unix() + int64(interval.Seconds())
+	outputFileName := tempStoragePrefix + startTime.Format(time.RFC3339) + ".avi"
+	outputPath, err := cam.archive.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("error creating archive %v: %v", outputFileName, err)
+	}
+
+	// Keep retention away from the file until the writer is closed
+	cam.setContinuousFile(outputFileName)
+	defer cam.setContinuousFile("")
+
+	cam.mut.Lock()
+	writer, err := gocv.VideoWriterFile(outputPath, "MJPG", 55, cam.img.Cols(), cam.img.Rows(), true)
+	cam.mut.Unlock()
+	if err != nil {
+		return fmt.Errorf("error opening video writer device %v: %v", outputPath, err)
+	}
+	defer writer.Close()
+
+	for ctx.Err() == nil {
+		curTime := time.Now().Unix()
+		if curTime >= goalTime || !cam.continuousEnabled() {
+			break
+		}
+
+		if cam.IsRunning() && cam.Connection().Connected {
+			cam.mut.Lock()
+			writer.Write(cam.img)
+			cam.mut.Unlock()
+			cam.metrics.TempFrameWritten()
+		}
+	}
+
+	log.Printf("[%v] %v elapsed; ephemerally written to disk at %v\n", cam.ID, time.Since(startTime).Round(time.Second), outputPath)
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// Detector finds objects in a frame. Each camera owns its detectors, so
+// implementations need not be safe for concurrent use.
+type Detector interface {
+	// Name identifies the detector in arming modes and metrics.
+	Name() string
+	Detect(img gocv.Mat) []Detection
+	Close() error
+}
+
+// CascadeConfig is one entry of the detectors: list, a Haar or LBP cascade
+// such as a frontal face, profile face, full body or license plate.
+type CascadeConfig struct {
+	// Name identifies the detector in arming modes and metrics; it
+	// defaults to Label.
+	Name  string
+	Label string
+	File  string
+	// Color is "#rrggbb" for the label's boxes unless overlay.colors sets one.
+	Color string
+	// DetectMultiScale tuning: how much the image shrinks between scales
+	// (default 1.1), how many neighbouring hits a detection needs (default
+	// 3) and the smallest and largest boxes as [width, height].
+	ScaleFactor  float64
+	MinNeighbors int
+	MinSize      []int
+	MaxSize      []int
+	// Enabled defaults to true.
+	Enabled *bool
+}
+
+func (c *CascadeConfig) validate() error {
+	if c.Label == "" {
+		return fmt.Errorf("detector needs a label")
+	}
+	if c.Name == "" {
+		c.Name = c.Label
+	}
+	if !validCameraID(c.Name) {
+		return fmt.Errorf("invalid detector name %q: use letters, digits, - and _", c.Name)
+	}
+	if c.Name == "motion" || c.Name == "objects" {
+		return fmt.Errorf("detector name %q is reserved", c.Name)
+	}
+	if c.File == "" {
+		return fmt.Errorf("detector %v needs a cascade file", c.Name)
+	}
+	if c.Color != "" {
+		if _, err := parseColor(c.Color); err != nil {
+			return fmt.Errorf("detector %v: %v", c.Name, err)
+		}
+	}
+	if c.ScaleFactor == 0 {
+		c.ScaleFactor = 1.1
+	}
+	if c.ScaleFactor <= 1 {
+		return fmt.Errorf("detector %v: scaleFactor must be greater than 1", c.Name)
+	}
+	if c.MinNeighbors == 0 {
+		c.MinNeighbors = 3
+	}
+	if c.MinNeighbors < 0 {
+		return fmt.Errorf("detector %v: minNeighbors must be positive", c.Name)
+	}
+	if len(c.MinSize) != 0 && len(c.MinSize) != 2 || len(c.MaxSize) != 0 && len(c.MaxSize) != 2 {
+		return fmt.Errorf("detector %v: minSize and maxSize are [width, height]", c.Name)
+	}
+	return nil
+}
+
+func (c CascadeConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// cascadeDetector runs a cascade; every hit gets the same label.
+type cascadeDetector struct {
+	config     CascadeConfig
+	minSize    image.Point
+	maxSize    image.Point
+	classifier gocv.CascadeClassifier
+}
+
+func newCascadeDetector(cfg CascadeConfig) (*cascadeDetector, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	d := &cascadeDetector{config: cfg, classifier: gocv.NewCascadeClassifier()}
+	if len(cfg.MinSize) == 2 {
+		d.minSize = image.Pt(cfg.MinSize[0], cfg.MinSize[1])
+	}
+	if len(cfg.MaxSize) == 2 {
+		d.maxSize = image.Pt(cfg.MaxSize[0], cfg.MaxSize[1])
+	}
+	if !d.classifier.Load(cfg.File) {
+		d.classifier.Close()
+		return nil, fmt.Errorf("error reading cascade file: %v", cfg.File)
+	}
+	return d, nil
+}
+
+func (d *cascadeDetector) Name() string { return d.config.Name }
+
+func (d *cascadeDetector) Detect(img gocv.Mat) []Detection {
+	detections := []Detection{}
+	rects := d.classifier.DetectMultiScaleWithParams(img, d.config.ScaleFactor, d.config.MinNeighbors, 0, d.minSize, d.maxSize)
+	for _, r := range rects {
+		detections = append(detections, Detection{Label: d.config.Label, Box: r})
+	}
+	return detections
+}
+
+func (d *cascadeDetector) Close() error {
+	return d.classifier.Close()
+}
+
+// DNNConfig is the dnn: section: a Caffe, TensorFlow or ONNX model run
+// with OpenCV's dnn module.
+type DNNConfig struct {
+	// Model is the weights file (.caffemodel, .pb or .onnx); Config is the
+	// matching .prototxt or .pbtxt, if the format needs one.
+	Model  string
+	Config string
+	// ClassesFile lists one class name per line; line N is class id N.
+	ClassesFile string
+	// Classes of interest; empty keeps every class.
+	Classes []string
+	// Confidence is the minimum score kept; NMS is the overlap (IoU) above
+	// which the weaker of two boxes of the same class is dropped.
+	Confidence float64
+	NMS        float64
+	// Input preprocessing: the network's input size, the factor pixel
+	// values are multiplied by after subtracting Mean, and whether to
+	// swap the blue and red channels.
+	InputWidth  int
+	InputHeight int
+	Scale       float64
+	Mean        []float64
+	SwapRB      bool
+	// Output is "ssd" ([1,1,N,7] detections) or "yolo" ([1,N,5+classes]).
+	Output string
+}
+
+type dnnDetector struct {
+	config  DNNConfig
+	net     gocv.Net
+	names   []string
+	classes map[string]bool
+}
+
+func newDNNDetector(cfg DNNConfig) (*dnnDetector, error) {
+	if cfg.Output != "ssd" && cfg.Output != "yolo" {
+		return nil, fmt.Errorf("dnn.output must be ssd or yolo")
+	}
+	if cfg.Confidence <= 0 || cfg.Confidence > 1 || cfg.NMS <= 0 || cfg.NMS > 1 {
+		return nil, fmt.Errorf("dnn.confidence and dnn.nms must be between 0 and 1")
+	}
+	if cfg.InputWidth <= 0 || cfg.InputHeight <= 0 {
+		return nil, fmt.Errorf("dnn.inputWidth and dnn.inputHeight must be positive")
+	}
+	if len(cfg.Mean) != 0 && len(cfg.Mean) != 3 {
+		return nil, fmt.Errorf("dnn.mean needs one value per channel")
+	}
+	if _, err := os.Stat(cfg.Model); err != nil {
+		return nil, fmt.Errorf("dnn.model: %v", err)
+	}
+
+	d := &dnnDetector{config: cfg, classes: map[string]bool{}}
+	if cfg.ClassesFile != "" {
+		names, err := readClassNames(cfg.ClassesFile)
+		if err != nil {
+			return nil, fmt.Errorf("dnn.classesFile: %v", err)
+		}
+		d.names = names
+	}
+	for _, class := range cfg.Classes {
+		if len(d.names) > 0 && !contains(d.names, class) {
+			return nil, fmt.Errorf("dnn.classes: %q is not in %v", class, cfg.ClassesFile)
+		}
+		d.classes[class] = true
+	}
+
+	if strings.EqualFold(filepath.Ext(cfg.Model), ".pb") && cfg.Config == "" {
+		d.net = gocv.ReadNetFromTensorflow(cfg.Model)
+	} else {
+		d.net = gocv.ReadNet(cfg.Model, cfg.Config)
+	}
+	if d.net.Empty() {
+		return nil, fmt.Errorf("unable to load dnn model %v", cfg.Model)
+	}
+	return d, nil
+}
+
+func readClassNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		names = append(names, strings.TrimSpace(scanner.Text()))
+	}
+	return names, scanner.Err()
+}
+
+func (d *dnnDetector) Name() string { return "objects" }
+
+func (d *dnnDetector) className(id int) string {
+	if id >= 0 && id < len(d.names) && d.names[id] != "" {
+		return d.names[id]
+	}
+	return fmt.Sprintf("class%d", id)
+}
+
+// keep reports whether a class is one of interest.
+func (d *dnnDetector) keep(label string) bool {
+	return len(d.classes) == 0 || d.classes[label]
+}
+
+func (d *dnnDetector) Detect(img gocv.Mat) []Detection {
+	mean := gocv.NewScalar(0, 0, 0, 0)
+	if len(d.config.Mean) == 3 {
+		mean = gocv.NewScalar(d.config.Mean[0], d.config.Mean[1], d.config.Mean[2], 0)
+	}
+	blob := gocv.BlobFromImage(img, d.config.Scale, image.Pt(d.config.InputWidth, d.config.InputHeight), mean, d.config.SwapRB, false)
+	defer blob.Close()
+	d.net.SetInput(blob, "")
+	out := d.net.Forward("")
+	defer out.Close()
+
+	var detections []Detection
+	if d.config.Output == "yolo" {
+		detections = d.parseYOLO(out, img.Cols(), img.Rows())
+	} else {
+		detections = d.parseSSD(out, img.Cols(), img.Rows())
+	}
+	return nonMaxSuppression(detections, d.config.NMS)
+}
+
+// parseSSD reads rows of [image, class, confidence, left, top, right,
+// bottom] with coordinates relative to the frame.
+func (d *dnnDetector) parseSSD(out gocv.Mat, cols, rows int) []Detection {
+	results := gocv.GetBlobChannel(out, 0, 0)
+	defer results.Close()
+
+	detections := []Detection{}
+	for i := 0; i < results.Rows(); i++ {
+		confidence := float64(results.GetFloatAt(i, 2))
+		if confidence < d.config.Confidence {
+			continue
+		}
+		label := d.className(int(results.GetFloatAt(i, 1)))
+		if !d.keep(label) {
+			continue
+		}
+		box := image.Rect(
+			int(results.GetFloatAt(i, 3)*float32(cols)),
+			int(results.GetFloatAt(i, 4)*float32(rows)),
+			int(results.GetFloatAt(i, 5)*float32(cols)),
+			int(results.GetFloatAt(i, 6)*float32(rows)),
+		).Intersect(image.Rect(0, 0, cols, rows))
+		if !box.Empty() {
+			detections = append(detections, Detection{Label: label, Box: box, Confidence: confidence})
+		}
+	}
+	return detections
+}
+
+// parseYOLO reads rows of [centre x, centre y, width, height, objectness,
+// class scores...] in input pixels, as exported by YOLOv5.
+func (d *dnnDetector) parseYOLO(out gocv.Mat, cols, rows int) []Detection {
+	dims := out.Size()
+	if len(dims) != 3 || dims[2] <= 5 {
+		return nil
+	}
+	sx := float64(cols) / float64(d.config.InputWidth)
+	sy := float64(rows) / float64(d.config.InputHeight)
+
+	detections := []Detection{}
+	for i := 0; i < dims[1]; i++ {
+		objectness := float64(out.GetFloatAt3(0, i, 4))
+		if objectness < d.config.Confidence {
+			continue
+		}
+		class, score := 0, float32(0)
+		for c := 5; c < dims[2]; c++ {
+			if s := out.GetFloatAt3(0, i, c); s > score {
+				class, score = c-5, s
+			}
+		}
+		confidence := objectness * float64(score)
+		if confidence < d.config.Confidence {
+			continue
+		}
+		label := d.className(class)
+		if !d.keep(label) {
+			continue
+		}
+		cx, cy := float64(out.GetFloatAt3(0, i, 0))*sx, float64(out.GetFloatAt3(0, i, 1))*sy
+		w, h := float64(out.GetFloatAt3(0, i, 2))*sx, float64(out.GetFloatAt3(0, i, 3))*sy
+		box := image.Rect(int(cx-w/2), int(cy-h/2), int(cx+w/2), int(cy+h/2)).Intersect(image.Rect(0, 0, cols, rows))
+		if !box.Empty() {
+			detections = append(detections, Detection{Label: label, Box: box, Confidence: confidence})
+		}
+	}
+	return detections
+}
+
+func (d *dnnDetector) Close() error {
+	return d.net.Close()
+}
+
+// iou is the intersection over union of two boxes.
+func iou(a, b image.Rectangle) float64 {
+	inter := a.Intersect(b)
+	if inter.Empty() {
+		return 0
+	}
+	i := float64(inter.Dx() * inter.Dy())
+	return i / (float64(a.Dx()*a.Dy()+b.Dx()*b.Dy()) - i)
+}
+
+// nonMaxSuppression keeps the most confident of any boxes of the same
+// label that overlap by more than threshold.
+func nonMaxSuppression(detections []Detection, threshold float64) []Detection {
+	sort.SliceStable(detections, func(i, j int) bool {
+		return detections[i].Confidence > detections[j].Confidence
+	})
+	kept := []Detection{}
+	for _, d := range detections {
+		suppressed := false
+		for _, k := range kept {
+			if k.Label == d.Label && iou(k.Box, d.Box) > threshold {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
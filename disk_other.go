@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+// diskSpace is not implemented on this platform.
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk space is not supported on this platform")
+}
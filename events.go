@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Detection is a single object found in a frame.
+type Detection struct {
+	Label      string
+	Box        image.Rectangle
+	Confidence float64 `json:",omitempty"`
+	// Zone is the detection zone the box is in, if the camera has any.
+	Zone string `json:",omitempty"`
+	// Track is the ID of the track the detection belongs to, if tracking is on.
+	Track int `json:",omitempty"`
+}
+
+// Event records that something happened in front of a camera. Clip and
+// Snapshot are file names inside the camera's archive folder.
+type Event struct {
+	ID         string
+	Time       time.Time
+	Camera     string
+	Kind       string
+	Detections []Detection
+	// Track is set on the events raised when a track starts or ends.
+	Track *Track `json:",omitempty"`
+	// Line and Direction (in or out) are set on crossing events.
+	Line      string `json:",omitempty"`
+	Direction string `json:",omitempty"`
+	// Rule and Dwell (seconds in the zone) are set on loitering events.
+	Rule     string  `json:",omitempty"`
+	Dwell    float64 `json:",omitempty"`
+	Clip     string  `json:",omitempty"`
+	Snapshot string  `json:",omitempty"`
+}
+
+// EventFilter selects events from the log. Zero values match everything.
+type EventFilter struct {
+	Camera string
+	Kind   string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f EventFilter) matches(e Event) bool {
+	if f.Camera != "" && e.Camera != f.Camera {
+		return false
+	}
+	if f.Kind != "" && e.Kind != f.Kind {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// EventLog is an append-only JSON-lines file of events. Once the file
+// reaches maxSize it is renamed to path.1, replacing the previous one, and
+// a new file is started, so at most two files' worth of events are kept.
+// Queries scan both files and keep every matching event in memory to sort
+// them newest first, so memory use grows with the number of matches.
+type EventLog struct {
+	path    string
+	maxSize int64
+	mut     sync.Mutex
+	file    *os.File
+	size    int64
+	seq     int64
+}
+
+// openEventLog appends to the log at path. A maxSize of 0 never rotates.
+func openEventLog(path string, maxSize int64) (*EventLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	l := &EventLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *EventLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the full log aside and starts a new one.
+func (l *EventLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Append assigns the event an ID and writes it to the log.
+func (l *EventLog) Append(e *Event) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.seq++
+	e.ID = e.Camera + "-" + strconv.FormatInt(e.Time.UnixNano(), 36) + strconv.FormatInt(l.seq, 36)
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := l.file.Write(append(js, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotating %v: %v", l.path, err)
+		}
+	}
+	return nil
+}
+
+// Query returns the total number of matching events and the requested page
+// of them, newest first.
+func (l *EventLog) Query(filter EventFilter, offset, limit int) (int, []Event, error) {
+	matched := []Event{}
+	err := l.scan(filter, func(e Event) {
+		matched = append(matched, e)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.After(matched[j].Time) })
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return total, matched[offset:end], nil
+}
+
+// scan calls fn with every matching event, oldest file first. The lock is
+// only held to open the files and note their sizes, so capture can keep
+// appending during a long scan; events appended since are left out, and
+// open files keep their contents if the log rotates meanwhile.
+func (l *EventLog) scan(filter EventFilter, fn func(Event)) error {
+	type part struct {
+		file *os.File
+		size int64
+	}
+	parts := []part{}
+	defer func() {
+		for _, p := range parts {
+			p.file.Close()
+		}
+	}()
+
+	l.mut.Lock()
+	if old, err := os.Open(l.path + ".1"); err == nil {
+		info, err := old.Stat()
+		if err != nil {
+			old.Close()
+			l.mut.Unlock()
+			return err
+		}
+		parts = append(parts, part{old, info.Size()})
+	}
+	current, err := os.Open(l.path)
+	if err != nil {
+		l.mut.Unlock()
+		return err
+	}
+	info, err := current.Stat()
+	if err != nil {
+		current.Close()
+		l.mut.Unlock()
+		return err
+	}
+	parts = append(parts, part{current, info.Size()})
+	l.mut.Unlock()
+
+	for _, p := range parts {
+		scanner := bufio.NewScanner(io.LimitReader(p.file, p.size))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// Skip a torn line from a crash rather than failing every query
+				continue
+			}
+			if filter.matches(e) {
+				fn(e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("reading %v: %v", p.file.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (l *EventLog) Close() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventLogQuery(t *testing.T) {
+	l, err := openEventLog(filepath.Join(t.TempDir(), "events", "events.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Events are identified by their minute past start, and appended out
+	// of order as cameras do not log in lockstep
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minute int) time.Time { return start.Add(time.Duration(minute) * time.Minute) }
+	for _, e := range []Event{
+		{Time: at(0), Camera: "front", Kind: "motion"},
+		{Time: at(2), Camera: "front", Kind: "person"},
+		{Time: at(1), Camera: "back", Kind: "motion"},
+		{Time: at(3), Camera: "back", Kind: "person"},
+		{Time: at(5), Camera: "front", Kind: "motion"},
+		{Time: at(4), Camera: "front", Kind: "motion"},
+	} {
+		e := e
+		if err := l.Append(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		filter        EventFilter
+		offset, limit int
+		total         int
+		// want are the minutes of the events returned
+		want []int
+	}{
+		{"everything newest first", EventFilter{}, 0, 50, 6, []int{5, 4, 3, 2, 1, 0}},
+		{"camera", EventFilter{Camera: "back"}, 0, 50, 2, []int{3, 1}},
+		{"kind", EventFilter{Kind: "person"}, 0, 50, 2, []int{3, 2}},
+		{"camera and kind", EventFilter{Camera: "front", Kind: "motion"}, 0, 50, 3, []int{5, 4, 0}},
+		{"since is inclusive", EventFilter{Since: at(4)}, 0, 50, 2, []int{5, 4}},
+		{"until is exclusive", EventFilter{Until: at(2)}, 0, 50, 2, []int{1, 0}},
+		{"time range", EventFilter{Since: at(1), Until: at(4)}, 0, 50, 3, []int{3, 2, 1}},
+		{"no match", EventFilter{Camera: "side"}, 0, 50, 0, []int{}},
+		{"first page", EventFilter{}, 0, 2, 6, []int{5, 4}},
+		{"second page", EventFilter{}, 2, 2, 6, []int{3, 2}},
+		{"last page is short", EventFilter{}, 4, 4, 6, []int{1, 0}},
+		{"past the end", EventFilter{}, 10, 2, 6, []int{}},
+		{"page of a filter", EventFilter{Kind: "motion"}, 1, 2, 4, []int{4, 1}},
+	}
+	for _, tt := range tests {
+		total, events, err := l.Query(tt.filter, tt.offset, tt.limit)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		got := []int{}
+		for _, e := range events {
+			got = append(got, int(e.Time.Sub(start)/time.Minute))
+		}
+		if total != tt.total || !equalInts(got, tt.want) {
+			t.Errorf("%v: Query() = %d, %v, want %d, %v", tt.name, total, got, tt.total, tt.want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEventLogIDs(t *testing.T) {
+	l, err := openEventLog(filepath.Join(t.TempDir(), "events.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Two events in the same instant still get their own IDs
+	now := time.Now()
+	first, second := Event{Time: now, Camera: "front"}, Event{Time: now, Camera: "front"}
+	if err := l.Append(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.ID == second.ID {
+		t.Errorf("IDs %q and %q, want two different ones", first.ID, second.ID)
+	}
+}
+
+func TestEventLogSkipsTornLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := openEventLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := l.Append(&Event{Time: time.Now(), Camera: "front", Kind: "motion"}); err != nil {
+		t.Fatal(err)
+	}
+	// A crash halfway through a write leaves part of a line behind
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"ID": "front-1", "Time": "2018-`)
+	file.Close()
+	if err := l.Append(&Event{Time: time.Now(), Camera: "front", Kind: "person"}); err != nil {
+		t.Fatal(err)
+	}
+
+	total, events, err := l.Query(EventFilter{}, 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The torn line swallows the next event, but the log stays readable
+	if total != 1 || events[0].Kind != "motion" {
+		t.Errorf("Query() = %d, %+v, want only the motion event", total, events)
+	}
+}
+
+func TestEventLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := openEventLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { l.Close() }()
+
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	appendAt := func(minute int) {
+		t.Helper()
+		if err := l.Append(&Event{Time: start.Add(time.Duration(minute) * time.Minute), Camera: "front", Kind: "motion"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want ...int) {
+		t.Helper()
+		total, events, err := l.Query(EventFilter{}, 0, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []int{}
+		for _, e := range events {
+			got = append(got, int(e.Time.Sub(start)/time.Minute))
+		}
+		if total != len(want) || !equalInts(got, want) {
+			t.Errorf("Query() = %d events %v, want %v", total, got, want)
+		}
+	}
+
+	// Every line has the same length, so the log rotates every two events
+	appendAt(1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.maxSize = 2 * info.Size()
+	for minute := 2; minute <= 5; minute++ {
+		appendAt(minute)
+	}
+	// 1 and 2 were in the file rotated away first
+	check(5, 4, 3)
+
+	// The size of the current file survives a restart
+	l.Close()
+	if l, err = openEventLog(path, 2*info.Size()); err != nil {
+		t.Fatal(err)
+	}
+	appendAt(6)
+	check(6, 5)
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("current file after rotation: %v, %v, want it empty", info, err)
+	}
+}
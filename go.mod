@@ -3,11 +3,12 @@ module github.com/zcking/gocam
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
 	github.com/hybridgroup/mjpeg v0.0.0-20140228234708-4680f319790e
-	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.3 // indirect
 	github.com/spf13/viper v1.2.1
 	github.com/stretchr/testify v1.2.2 // indirect
 	gocv.io/x/gocv v0.16.0
+	golang.org/x/crypto v0.0.0-20181030102418-4d3f4d9ffa16
 	golang.org/x/sys v0.0.0-20181022134430-8a28ead16f52 // indirect
 )
@@ -1,6 +1,7 @@
 import Vue from 'vue'
 import BootstrapVue from 'bootstrap-vue/dist/bootstrap-vue.esm'
 import App from './App.vue'
+import axios from 'axios';
 
 import 'bootstrap/dist/css/bootstrap.css';
 import 'bootstrap-vue/dist/bootstrap-vue.css';
@@ -9,6 +10,9 @@ Vue.use(BootstrapVue);
 
 Vue.config.productionTip = false;
 
+// Send the session cookie with API requests to the GoCam server
+axios.defaults.withCredentials = true;
+
 new Vue({
   render: h => h(App),
 }).$mount('#app');
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// CameraStatus is one camera's entry in /api/status.
+type CameraStatus struct {
+	ID             string
+	Name           string
+	Source         string
+	PowerOn        bool
+	Connection     ConnectionState
+	LastFrame      time.Time `json:",omitempty"`
+	FrameAge       float64   // seconds since the last captured frame
+	DetectorLoaded bool
+	Detectors      []string
+	Recorder       RecorderStatus
+	// Problem explains why the camera makes GoCam not ready, if it does.
+	Problem string `json:",omitempty"`
+}
+
+// RecorderStatus reports what a camera is currently writing.
+type RecorderStatus struct {
+	Mode           string
+	EventRecording bool
+	EventClip      string `json:",omitempty"`
+	ContinuousFile string `json:",omitempty"`
+}
+
+// DiskStatus reports space on the file system holding the archive.
+type DiskStatus struct {
+	Path       string
+	FreeBytes  uint64
+	TotalBytes uint64
+	Error      string `json:",omitempty"`
+}
+
+// Status is the document served at /api/status.
+type Status struct {
+	Ready     bool
+	Problems  []string `json:",omitempty"`
+	Mode      string   `json:",omitempty"`
+	Version   string
+	GoVersion string
+	Started   time.Time
+	Uptime    float64 // seconds
+	Cameras   []CameraStatus
+	Disk      DiskStatus
+}
+
+func cameraStatus(cam *Camera, now time.Time) CameraStatus {
+	status := CameraStatus{
+		ID:             cam.ID,
+		Name:           cam.Name,
+		Source:         cam.SourceName(),
+		PowerOn:        cam.IsRunning(),
+		Connection:     cam.Connection(),
+		LastFrame:      cam.metrics.LastFrame(),
+		DetectorLoaded: len(cam.detectors) > 0,
+		Detectors:      []string{},
+		Recorder: RecorderStatus{
+			Mode:           cam.config.RecordMode,
+			ContinuousFile: cam.ContinuousFile(),
+		},
+	}
+	for _, d := range cam.detectors {
+		status.Detectors = append(status.Detectors, d.Name())
+	}
+	if !status.LastFrame.IsZero() {
+		status.FrameAge = now.Sub(status.LastFrame).Seconds()
+	}
+
+	cam.mut.Lock()
+	status.Recorder.EventRecording = cam.recorder.Recording()
+	status.Recorder.EventClip = cam.recorder.CurrentClip()
+	cam.mut.Unlock()
+
+	// A camera switched off on purpose is not a problem
+	maxAge := viper.GetDuration("health.maxFrameAge")
+	switch {
+	case !status.PowerOn:
+	case !status.Connection.Connected:
+		status.Problem = "camera disconnected: " + status.Connection.LastError
+	case status.LastFrame.IsZero() || now.Sub(status.LastFrame) > maxAge:
+		status.Problem = fmt.Sprintf("no frame captured in the last %v", maxAge)
+	}
+	return status
+}
+
+// currentStatus gathers the state of every camera and the archive disk,
+// and decides whether GoCam is ready.
+func currentStatus() Status {
+	now := time.Now()
+	status := Status{
+		Ready:     true,
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Started:   startTime,
+		Uptime:    now.Sub(startTime).Seconds(),
+		Cameras:   []CameraStatus{},
+		Disk:      DiskStatus{Path: archiveRoot},
+	}
+
+	status.Mode, _ = arming.Current()
+	for _, cam := range cameras {
+		cs := cameraStatus(cam, now)
+		if cs.Problem != "" {
+			status.Problems = append(status.Problems, cam.ID+": "+cs.Problem)
+		}
+		status.Cameras = append(status.Cameras, cs)
+	}
+
+	free, total, err := diskSpace(archiveRoot)
+	if err != nil {
+		status.Disk.Error = err.Error()
+	} else {
+		status.Disk.FreeBytes, status.Disk.TotalBytes = free, total
+		minFree, _ := parseByteSize(viper.GetString("health.minFreeDisk"))
+		if free < uint64(minFree) {
+			status.Problems = append(status.Problems, fmt.Sprintf("only %d bytes free in %v", free, archiveRoot))
+		}
+	}
+
+	status.Ready = len(status.Problems) == 0
+	return status
+}
+
+// LiveHandler serves GET /health/live: 200 as long as the process is serving.
+func LiveHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	writeJSON(w, map[string]string{"Status": "ok"})
+}
+
+// ReadyHandler serves GET /health/ready: 200 when every powered-on camera
+// is delivering fresh frames and the archive disk has room, 503 otherwise.
+// It needs no login, so the reasons are only given by /api/status.
+func ReadyHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	body := map[string]string{"Status": "ok"}
+	if !currentStatus().Ready {
+		body = map[string]string{"Status": "unavailable"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, body)
+}
+
+// StatusHandler serves GET /api/status with the detailed state of GoCam.
+func StatusHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	writeJSON(w, currentStatus())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCurrentStatus(t *testing.T) {
+	useAuthenticator(t, &Authenticator{})
+	viper.Set("health.maxFrameAge", "10s")
+	viper.Set("health.minFreeDisk", "0")
+	t.Cleanup(viper.Reset)
+
+	tests := []struct {
+		name  string
+		setup func(cam *Camera)
+		// problem is part of the camera's problem, or empty when it is fine
+		problem string
+	}{
+		{"fresh frames", func(cam *Camera) {
+			cam.metrics.FrameCaptured(time.Now().Add(-time.Second))
+		}, ""},
+		{"powered off", func(cam *Camera) {
+			cam.SetRunning(false)
+		}, ""},
+		{"disconnected", func(cam *Camera) {
+			cam.metrics.FrameCaptured(time.Now())
+			cam.setConnected(false, errors.New("device unplugged"))
+		}, "camera disconnected: device unplugged"},
+		{"stale frame", func(cam *Camera) {
+			cam.metrics.FrameCaptured(time.Now().Add(-time.Minute))
+		}, "no frame captured in the last 10s"},
+		{"no frame yet", func(cam *Camera) {}, "no frame captured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy := newTestCamera(t, "back")
+			healthy.SetRunning(true)
+			healthy.metrics.FrameCaptured(time.Now())
+			cam := newTestCamera(t, "front")
+			cam.SetRunning(true)
+			tt.setup(cam)
+			useCameras(t, cam, healthy)
+
+			status := currentStatus()
+			if got := status.Cameras[0].Problem; !strings.Contains(got, tt.problem) || (tt.problem == "") != (got == "") {
+				t.Errorf("problem = %q, want %q", got, tt.problem)
+			}
+			if status.Cameras[1].Problem != "" {
+				t.Errorf("healthy camera has problem %q", status.Cameras[1].Problem)
+			}
+			problems := 0
+			if tt.problem != "" {
+				problems = 1
+			}
+			if status.Ready != (problems == 0) || len(status.Problems) != problems {
+				t.Errorf("Ready = %v with problems %q", status.Ready, status.Problems)
+			}
+
+			w := httptest.NewRecorder()
+			ReadyHandler(w, httptest.NewRequest("GET", "/health/ready", nil))
+			want := http.StatusOK
+			if tt.problem != "" {
+				want = http.StatusServiceUnavailable
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			// Anyone may ask, so the reasons stay out of the answer
+			if w.Code != want || len(body) != 1 || (body["Status"] == "ok") != (want == http.StatusOK) {
+				t.Errorf("/health/ready = %d %v, want %d and only a status", w.Code, body, want)
+			}
+		})
+	}
+}
+
+// inTempDir runs the rest of a test in an empty directory with an archive
+// folder, which the disk checks find relative to the working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir(archiveRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCurrentStatusDisk(t *testing.T) {
+	inTempDir(t)
+	useCameras(t)
+	t.Cleanup(viper.Reset)
+
+	for _, tt := range []struct {
+		minFree string
+		ready   bool
+	}{
+		{"0", true},
+		{"1000000TB", false},
+	} {
+		viper.Set("health.minFreeDisk", tt.minFree)
+		status := currentStatus()
+		if status.Disk.Error != "" {
+			t.Skipf("free space unavailable: %v", status.Disk.Error)
+		}
+		if status.Ready != tt.ready {
+			t.Errorf("Ready = %v with minFreeDisk %v, want %v (problems %q)", status.Ready, tt.minFree, tt.ready, status.Problems)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// LoiterRule alerts when a tracked object stays inside a zone too long:
+// once after After, and again after EscalateAfter if set.
+type LoiterRule struct {
+	Name string
+	// Zone is the name of one of the camera's include zones.
+	Zone string
+	// Labels the rule applies to, e.g. person; empty means every label.
+	Labels        []string
+	After         time.Duration
+	EscalateAfter time.Duration
+}
+
+func (r *LoiterRule) validate(zones *ZoneSet) error {
+	if r.Name == "" {
+		r.Name = r.Zone
+	}
+	if !validCameraID(r.Name) {
+		return fmt.Errorf("invalid loitering rule name %q: use letters, digits, - and _", r.Name)
+	}
+	if !zones.hasInclude(r.Zone) {
+		return fmt.Errorf("loitering rule %v: %q is not an include zone", r.Name, r.Zone)
+	}
+	if r.After <= 0 {
+		return fmt.Errorf("loitering rule %v: after must be positive", r.Name)
+	}
+	if r.EscalateAfter != 0 && r.EscalateAfter <= r.After {
+		return fmt.Errorf("loitering rule %v: escalateAfter must be longer than after", r.Name)
+	}
+	return nil
+}
+
+// Loitering is a rule firing for a track.
+type Loitering struct {
+	Rule string
+	// Kind is loitering for the first threshold and loitering_escalated
+	// for the second.
+	Kind string
+	// Dwell is how long the object has been in the zone.
+	Dwell time.Duration
+	Track Track
+}
+
+// LoiterSet is one camera's loitering rules.
+type LoiterSet struct {
+	rules []LoiterRule
+	// fired is how many thresholds each rule has fired for each track
+	// during its current stay in the zone
+	fired map[string]map[int]int
+}
+
+func newLoiterSet(rules []LoiterRule, zones *ZoneSet) (*LoiterSet, error) {
+	set := &LoiterSet{fired: map[string]map[int]int{}}
+	for _, rule := range rules {
+		if err := rule.validate(zones); err != nil {
+			return nil, err
+		}
+		if _, ok := set.fired[rule.Name]; ok {
+			return nil, fmt.Errorf("loitering rule %v already exists", rule.Name)
+		}
+		set.rules = append(set.rules, rule)
+		set.fired[rule.Name] = map[int]int{}
+	}
+	return set, nil
+}
+
+// Check returns the rules that fire at now for the active tracks and
+// forgets the tracks that ended.
+func (s *LoiterSet) Check(now time.Time, active, ended []Track) []Loitering {
+	for _, track := range ended {
+		for _, fired := range s.fired {
+			delete(fired, track.ID)
+		}
+	}
+
+	alerts := []Loitering{}
+	for _, rule := range s.rules {
+		fired := s.fired[rule.Name]
+		for _, track := range active {
+			if track.Zone != rule.Zone || len(rule.Labels) > 0 && !contains(rule.Labels, track.Label) {
+				// Leaving the zone starts a new stay
+				delete(fired, track.ID)
+				continue
+			}
+			dwell := now.Sub(track.ZoneSince)
+			switch {
+			case fired[track.ID] == 0 && dwell >= rule.After:
+				fired[track.ID] = 1
+				alerts = append(alerts, Loitering{rule.Name, "loitering", dwell, track})
+			case fired[track.ID] == 1 && rule.EscalateAfter > 0 && dwell >= rule.EscalateAfter:
+				fired[track.ID] = 2
+				alerts = append(alerts, Loitering{rule.Name, "loitering_escalated", dwell, track})
+			}
+		}
+	}
+	return alerts
+}
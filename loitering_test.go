@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoiterSetCheck(t *testing.T) {
+	zones, err := newZoneSet([]DetectionZone{
+		{Name: "porch", Points: [][2]float64{{0, 0}, {0.5, 0}, {0.5, 1}, {0, 1}}},
+		{Name: "drive", Points: [][2]float64{{0.5, 0}, {1, 0}, {1, 1}, {0.5, 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	porch := LoiterRule{Name: "porch", Zone: "porch", Labels: []string{"person"}, After: 30 * time.Second, EscalateAfter: 2 * time.Minute}
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	in := func(id int, label, zone string, since time.Duration) Track {
+		return Track{ID: id, Label: label, Zone: zone, ZoneSince: start.Add(since)}
+	}
+
+	type step struct {
+		at     time.Duration
+		active []Track
+		ended  []Track
+		// want are the alert kinds raised, in order
+		want []string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"fires once after the threshold", []step{
+			{10 * time.Second, []Track{in(1, "person", "porch", 0)}, nil, nil},
+			{30 * time.Second, []Track{in(1, "person", "porch", 0)}, nil, []string{"loitering"}},
+			{40 * time.Second, []Track{in(1, "person", "porch", 0)}, nil, nil},
+		}},
+		{"escalates once", []step{
+			{time.Minute, []Track{in(1, "person", "porch", 0)}, nil, []string{"loitering"}},
+			{2 * time.Minute, []Track{in(1, "person", "porch", 0)}, nil, []string{"loitering_escalated"}},
+			{3 * time.Minute, []Track{in(1, "person", "porch", 0)}, nil, nil},
+		}},
+		{"long stay seen late fires the first threshold first", []step{
+			{5 * time.Minute, []Track{in(1, "person", "porch", 0)}, nil, []string{"loitering"}},
+			{5*time.Minute + time.Second, []Track{in(1, "person", "porch", 0)}, nil, []string{"loitering_escalated"}},
+		}},
+		{"other labels ignored", []step{
+			{time.Minute, []Track{in(1, "car", "porch", 0)}, nil, nil},
+		}},
+		{"other zones ignored", []step{
+			{time.Minute, []Track{in(1, "person", "drive", 0)}, nil, nil},
+		}},
+		{"dwell counts from entering the zone", []step{
+			{time.Minute, []Track{in(1, "person", "porch", 45*time.Second)}, nil, nil},
+			{75 * time.Second, []Track{in(1, "person", "porch", 45*time.Second)}, nil, []string{"loitering"}},
+		}},
+		{"leaving and returning starts a new stay", []step{
+			{time.Minute, []Track{in(1, "person", "porch", 0)}, nil, []string{"loitering"}},
+			{70 * time.Second, []Track{in(1, "person", "drive", 70*time.Second)}, nil, nil},
+			{80 * time.Second, []Track{in(1, "person", "porch", 80*time.Second)}, nil, nil},
+			{110 * time.Second, []Track{in(1, "person", "porch", 80*time.Second)}, nil, []string{"loitering"}},
+		}},
+		{"each track alerts", []step{
+			{time.Minute, []Track{in(1, "person", "porch", 0), in(2, "person", "porch", 0)}, nil, []string{"loitering", "loitering"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := newLoiterSet([]LoiterRule{porch}, zones)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				alerts := set.Check(now, s.active, s.ended)
+				if len(alerts) != len(s.want) {
+					t.Fatalf("step %d: got %d alerts %+v, want %v", i, len(alerts), alerts, s.want)
+				}
+				for j, alert := range alerts {
+					if alert.Kind != s.want[j] || alert.Rule != "porch" {
+						t.Errorf("step %d: alert %d is %v from %v, want %v from porch", i, j, alert.Kind, alert.Rule, s.want[j])
+					}
+					if want := now.Sub(alert.Track.ZoneSince); alert.Dwell != want {
+						t.Errorf("step %d: dwell %v, want %v", i, alert.Dwell, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLoiterSetForget(t *testing.T) {
+	zones, err := newZoneSet([]DetectionZone{{Name: "porch", Points: [][2]float64{{0, 0}, {1, 0}, {1, 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := newLoiterSet([]LoiterRule{{Zone: "porch", After: time.Second}}, zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	track := Track{ID: 1, Label: "person", Zone: "porch", ZoneSince: start}
+	if got := set.Check(start.Add(time.Minute), []Track{track}, nil); len(got) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(got))
+	}
+
+	// Track IDs are never reused, but an ended track must not be remembered
+	set.Check(start.Add(time.Minute), nil, []Track{track})
+	if len(set.fired["porch"]) != 0 {
+		t.Fatalf("ended track still remembered")
+	}
+	if got := set.Check(start.Add(time.Minute), []Track{track}, nil); len(got) != 1 {
+		t.Errorf("alert after the track ended not raised again")
+	}
+}
+
+func TestNewLoiterSetErrors(t *testing.T) {
+	zones, err := newZoneSet([]DetectionZone{
+		{Name: "porch", Points: [][2]float64{{0, 0}, {0.5, 0}, {0.5, 1}}},
+		{Name: "street", Type: "exclude", Points: [][2]float64{{0.5, 0}, {1, 0}, {1, 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		rules []LoiterRule
+	}{
+		{"unknown zone", []LoiterRule{{Zone: "garden", After: time.Minute}}},
+		{"exclude zone", []LoiterRule{{Zone: "street", After: time.Minute}}},
+		{"no threshold", []LoiterRule{{Zone: "porch"}}},
+		{"escalates too early", []LoiterRule{{Zone: "porch", After: time.Minute, EscalateAfter: time.Minute}}},
+		{"duplicate", []LoiterRule{{Zone: "porch", After: time.Minute}, {Zone: "porch", After: 2 * time.Minute}}},
+	}
+	for _, tt := range tests {
+		if _, err := newLoiterSet(tt.rules, zones); err == nil {
+			t.Errorf("%v: newLoiterSet() succeeded, want an error", tt.name)
+		}
+	}
+}
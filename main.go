@@ -1,54 +1,55 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"image/color"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/hybridgroup/mjpeg"
 	"github.com/spf13/viper"
-	"gocv.io/x/gocv"
 )
 
-const tempStoragePrefix string = "TMP_"
-
-var (
-	deviceID   int
-	webcam     *gocv.VideoCapture
-	stream     *mjpeg.Stream
-	xmlFile    string
-	classifier gocv.CascadeClassifier
-	blue       color.RGBA
+const (
+	tempStoragePrefix string = "TMP_"
+	snapshotPrefix    string = "SNAP_"
 )
 
 var (
-	img gocv.Mat
-	mut sync.Mutex
-)
-
-var (
-	isRunning = true
-	runMut    sync.Mutex
+	eventLog      *EventLog
+	notifier      *Notifier
+	authenticator *Authenticator
 )
 
 type PowerResponse struct {
 	PowerOn bool
 }
 
-var writeMut sync.Mutex
-
 func main() {
-	defer func() { log.Println("Gocam shutting down...") }()
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin and print its bcrypt hash for auth.users")
+	genAPIKey := flag.Bool("gen-api-key", false, "print a new API key and its keyHash for auth.apiKeys")
+	flag.Parse()
+	if *hashPassword || *genAPIKey {
+		var err error
+		if *hashPassword {
+			err = hashPasswordCommand()
+		} else {
+			err = genAPIKeyCommand()
+		}
+		if err != nil {
+			log.Fatalf("[ERROR]: %v\n", err)
+		}
+		return
+	}
 
 	// Parse the configuration file
 	viper.SetConfigName("default")
@@ -64,141 +65,286 @@ func main() {
 	// Set defaults for configuration
 	viper.SetDefault("host", "127.0.0.1")
 	viper.SetDefault("port", 5000)
+	viper.SetDefault("source", "")
 	viper.SetDefault("captureDevice", 0)
 	viper.SetDefault("facialDetectionFile", filepath.Join("data", ""))
 	viper.SetDefault("tempRecLength", "0m")
 	viper.SetDefault("tempKeepTime", "0m")
+	viper.SetDefault("retention.interval", "1m")
+	viper.SetDefault("retention.minFreeDisk", "0")
+	viper.SetDefault("recordMode", "continuous")
+	viper.SetDefault("motion.method", "diff")
+	viper.SetDefault("motion.sensitivity", 0.5)
+	viper.SetDefault("motion.minArea", 500)
+	viper.SetDefault("events.triggers", []string{"motion", "manual"})
+	viper.SetDefault("events.bufferMemory", "64MB")
+	viper.SetDefault("events.cooldown", "30s")
+	viper.SetDefault("events.snapshots", true)
+	viper.SetDefault("overlay.timestamp", true)
+	viper.SetDefault("overlay.timestampFormat", "2006-01-02 15:04:05")
+	viper.SetDefault("overlay.cameraName", false)
+	viper.SetDefault("overlay.text", "")
+	viper.SetDefault("overlay.position", "top-left")
+	viper.SetDefault("overlay.scale", 1.0)
+	viper.SetDefault("overlay.boxes", true)
+	viper.SetDefault("dnn.model", "")
+	viper.SetDefault("dnn.config", "")
+	viper.SetDefault("dnn.classesFile", "")
+	viper.SetDefault("dnn.classes", []string{})
+	viper.SetDefault("dnn.confidence", 0.5)
+	viper.SetDefault("dnn.nms", 0.4)
+	viper.SetDefault("dnn.inputWidth", 300)
+	viper.SetDefault("dnn.inputHeight", 300)
+	viper.SetDefault("dnn.scale", 1/127.5)
+	viper.SetDefault("dnn.mean", []float64{127.5, 127.5, 127.5})
+	viper.SetDefault("dnn.swapRB", false)
+	viper.SetDefault("dnn.output", "ssd")
+	viper.SetDefault("tracking.enabled", false)
+	viper.SetDefault("tracking.minIoU", 0.3)
+	viper.SetDefault("tracking.maxDistance", 0.1)
+	viper.SetDefault("tracking.minHits", 3)
+	viper.SetDefault("tracking.maxAge", "2s")
+	viper.SetDefault("tracking.maxPath", 200)
+	viper.SetDefault("reconnect.initialBackoff", "1s")
+	viper.SetDefault("reconnect.maxBackoff", "1m")
+	viper.SetDefault("events.logFile", filepath.Join("events", "events.jsonl"))
+	viper.SetDefault("events.logMaxSize", "64MB")
+	viper.SetDefault("webhookLog", filepath.Join("events", "webhooks.jsonl"))
+	viper.SetDefault("webhookLogMaxSize", "16MB")
+	viper.SetDefault("publicURL", "")
+	viper.SetDefault("scheduleTimeZone", "")
+	viper.SetDefault("stateFile", filepath.Join("state", "state.json"))
+	viper.SetDefault("defaultMode", "")
+	viper.SetDefault("metrics.public", false)
+	viper.SetDefault("health.maxFrameAge", "10s")
+	viper.SetDefault("health.minFreeDisk", "100MB")
+	viper.SetDefault("auth.sessionTTL", "12h")
+	viper.SetDefault("auth.signedURLTTL", "1h")
+	viper.SetDefault("tls.enabled", false)
+	viper.SetDefault("tls.cert", "")
+	viper.SetDefault("tls.key", "")
+	viper.SetDefault("tls.selfSigned", true)
+	viper.SetDefault("tls.dir", "tls")
+	viper.SetDefault("tls.hosts", []string{})
+	viper.SetDefault("tls.redirectHTTP", "")
+	viper.SetDefault("auth.allowedOrigins", []string{})
 	viper.SetDefault("contrast", 0.5)
 	viper.SetDefault("saturation", 0.75)
 	viper.SetDefault("fps", 20)
 	viper.SetDefault("brightness", 0.6)
 
 	// Parse arguments
-	deviceID = viper.GetInt("captureDevice")
-	xmlFile = viper.GetString("facialDetectionFile")
 	host := viper.GetString("host") + ":" + viper.GetString("port")
-	tempRecLength, _ := time.ParseDuration(viper.GetString("tempRecLength"))
-	tempKeepTime, _ := time.ParseDuration(viper.GetString("tempKeepTime"))
+	useTLS := viper.GetBool("tls.enabled")
+	cameraConfigs, err := loadCameraConfigs()
+	if err != nil {
+		log.Fatalf("[ERROR]: Failed to configure cameras: %v\n", err)
+	}
+	retention, err := loadRetentionConfig()
+	if err != nil {
+		log.Fatalf("[ERROR]: Failed to configure retention: %v\n", err)
+	}
+	if _, err := parseByteSize(viper.GetString("health.minFreeDisk")); err != nil {
+		log.Fatalf("[ERROR]: health.minFreeDisk: %v\n", err)
+	}
 
-	// Color for the rect when faces detected
-	blue = color.RGBA{B: 255}
+	// Detections are appended to the event log
+	logMaxSize, err := parseByteSize(viper.GetString("events.logMaxSize"))
+	if err != nil {
+		log.Fatalf("[ERROR]: events.logMaxSize: %v\n", err)
+	}
+	eventLog, err = openEventLog(viper.GetString("events.logFile"), logMaxSize)
+	if err != nil {
+		log.Fatalf("[ERROR]: Unable to open event log: %v\n", err)
+	}
 
-	// Open webcam
-	webcam, err = gocv.VideoCaptureDevice(int(deviceID))
+	// Settings changed through the API, such as the arming mode, are kept in stateFile
+	state, err = openStateStore(viper.GetString("stateFile"))
 	if err != nil {
-		log.Fatalln(err)
-		return
+		log.Fatalf("[ERROR]: Unable to open state file: %v\n", err)
+	}
+	arming, err = loadArmingModes(state.Get().Mode)
+	if err != nil {
+		log.Fatalf("[ERROR]: Failed to configure modes: %v\n", err)
 	}
-	defer webcam.Close()
 
-	// Setup OS signal trapping to do proper cleanup of webcam on exit
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGINT)
-	signal.Stop(sigCh)
-	go func() {
-		for sig := range sigCh {
-			// sig is a ^C, handle it
-			log.Fatalf("Received Signal: %v\n", sig)
-			log.Println("Waiting for 2 seconds to finish shutting down...")
-			log.Println("Gocam shutting down...")
-			webcam.Close()
-			time.Sleep(2 * time.Second)
-			os.Exit(0)
+	// Schedules decide when recording, detection and notifications run
+	cameraIDs := []string{}
+	for _, cfg := range cameraConfigs {
+		cameraIDs = append(cameraIDs, cfg.ID)
+	}
+	scheduler, err = loadScheduler(cameraIDs)
+	if err != nil {
+		log.Fatalf("[ERROR]: Failed to configure schedules: %v\n", err)
+	}
+
+	// Every endpoint but /health and /api/login requires credentials once users exist
+	authenticator, err = loadAuthenticator()
+	if err != nil {
+		log.Fatalf("[ERROR]: Failed to configure authentication: %v\n", err)
+	}
+
+	// Events are also pushed to any configured webhooks
+	webhooks, err := loadWebhookConfigs()
+	if err != nil {
+		log.Fatalf("[ERROR]: Failed to configure webhooks: %v\n", err)
+	}
+	publicURL := strings.TrimRight(viper.GetString("publicURL"), "/")
+	if publicURL == "" {
+		publicURL = "http://" + host
+		if useTLS {
+			publicURL = "https://" + host
 		}
-	}()
-
-	// Video capture settings
-	log.Printf("Video capture configured with codec %q\n", webcam.CodecString())
-	webcam.Set(gocv.VideoCaptureSaturation, viper.GetFloat64("saturation"))
-	webcam.Set(gocv.VideoCaptureFPS, viper.GetFloat64("fps"))
-	webcam.Set(gocv.VideoCaptureBrightness, viper.GetFloat64("brightness"))
-	webcam.Set(gocv.VideoCaptureContrast, viper.GetFloat64("contrast"))
-
-	// Prepare image matrix
-	img = gocv.NewMat()
-	defer img.Close()
-
-	// Create the mjpeg stream
-	stream = mjpeg.NewStream()
-	stream.FrameInterval = 25 * time.Millisecond
-
-	// Enable face detection
-	// Load classifier to recognize faces
-	if xmlFile != "" {
-		classifier = gocv.NewCascadeClassifier()
-		defer classifier.Close()
-
-		if !classifier.Load(xmlFile) {
-			log.Fatalf("Error reading cascade file: %v\n", xmlFile)
-			return
+	}
+	webhookLogMaxSize, err := parseByteSize(viper.GetString("webhookLogMaxSize"))
+	if err != nil {
+		log.Fatalf("[ERROR]: webhookLogMaxSize: %v\n", err)
+	}
+	notifier, err = newNotifier(webhooks, publicURL, viper.GetString("webhookLog"), webhookLogMaxSize)
+	if err != nil {
+		log.Fatalf("[ERROR]: Unable to open webhook delivery log: %v\n", err)
+	}
+
+	// Open every camera before starting any of them
+	for _, cfg := range cameraConfigs {
+		cam, err := newCamera(cfg)
+		if err != nil {
+			log.Fatalf("[ERROR]: %v\n", err)
 		}
+		cameras = append(cameras, cam)
+		camerasByID[cam.ID] = cam
+	}
+
+	// Everything started from here on stops when ctx is cancelled; a
+	// background failure is reported on failures and shuts GoCam down
+	ctx, cancel := context.WithCancel(context.Background())
+	failures := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failures <- err:
+		default:
+		}
+	}
+
+	// Trap SIGINT/SIGTERM so recordings are finalized before exiting
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	for _, cam := range cameras {
+		cam.Start(ctx, fail)
+	}
+
+	// Delete old recordings according to the retention rules
+	go runRetention(ctx, retention)
+
+	// Spin up the controller server
+	http.HandleFunc("/health", HealthHandler)
+	http.HandleFunc("/health/live", LiveHandler)
+	http.HandleFunc("/health/ready", ReadyHandler)
+	http.HandleFunc("/api/status", requireRole(RoleViewer, StatusHandler))
+	http.HandleFunc("/api/login", LoginHandler)
+	if viper.GetBool("metrics.public") {
+		http.HandleFunc("/metrics", MetricsHandler)
 	} else {
-		log.Println("[WARN]: No facial detection data file provided; facial detection disabled.")
-	}
-
-	// Capture a single image just to initialize the image variable
-	captureImage()
-
-	// Capture images from the camera in parallel
-	go func() {
-		for {
-			runMut.Lock()
-			r := isRunning
-			runMut.Unlock()
-			if r {
-				captureImage()
-				if xmlFile != "" {
-					detectFaces()
-				}
+		http.HandleFunc("/metrics", requireRole(RoleViewer, MetricsHandler))
+	}
+	http.HandleFunc("/api/logout", LogoutHandler)
+	http.HandleFunc("/api/power/off", requireRole(RoleAdmin, PowerOffHandler))
+	http.HandleFunc("/api/power/on", requireRole(RoleAdmin, PowerOnHandler))
+	http.HandleFunc("/api/power", requireRole(RoleViewer, GetPowerHandler))
+	http.HandleFunc("/cam", requireRole(RoleViewer, ServeCamera))
+	http.HandleFunc("/cam/", requireRole(RoleViewer, ServeCamera))
+	http.HandleFunc("/api/cameras", requireRole(RoleViewer, ListCamerasHandler))
+	http.HandleFunc("/api/cameras/", requireRole(RoleViewer, CameraHandler))
+	http.HandleFunc("/api/events", requireRole(RoleViewer, ListEventsHandler))
+	http.HandleFunc("/api/webhooks/deliveries", requireRole(RoleAdmin, WebhookDeliveriesHandler))
+	http.HandleFunc("/api/mode", requireRole(RoleViewer, ModeHandler))
+	http.HandleFunc("/api/schedule", requireRole(RoleViewer, ScheduleHandler))
+	http.HandleFunc("/api/tracks", requireRole(RoleViewer, TracksHandler))
+	http.HandleFunc("/api/counters", requireRole(RoleViewer, CountersHandler))
+	http.HandleFunc("/api/masks", requireRole(RoleViewer, MasksHandler))
+	http.HandleFunc("/api/masks/", requireRole(RoleViewer, MasksHandler))
+	http.HandleFunc("/api/snapshot", requireRole(RoleViewer, SnapshotHandler))
+	http.HandleFunc("/api/archives", requireRole(RoleViewer, ListArchivesHandler))
+	http.HandleFunc("/api/archives/", requireRole(RoleViewer, ArchiveHandler))
+
+	// Archives are served per camera at /archives/{id}/{file}
+	http.HandleFunc("/archives/", requireRole(RoleViewer, ServeArchive))
+
+	server := &http.Server{Addr: host}
+	servers := []*http.Server{server}
+	if !useTLS {
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				fail(err)
 			}
-		}
-	}()
-
-	// Start capturing for mjpeg stream
-	go func() {
-		for {
-			runMut.Lock()
-			r := isRunning
-			runMut.Unlock()
-			if r {
-				mjpegCapture()
+		}()
+	} else {
+		// Serve HTTPS with the configured certificate, or one we generate and keep in tls.dir
+		certFile, keyFile := viper.GetString("tls.cert"), viper.GetString("tls.key")
+		if certFile == "" || keyFile == "" {
+			if !viper.GetBool("tls.selfSigned") {
+				log.Fatalln("[ERROR]: tls.cert and tls.key are required unless tls.selfSigned is enabled")
+			}
+			certFile, keyFile, err = ensureSelfSignedCertificate(viper.GetString("tls.dir"), viper.GetStringSlice("tls.hosts"))
+			if err != nil {
+				log.Fatalf("[ERROR]: Unable to create a self-signed certificate: %v\n", err)
 			}
 		}
-	}()
 
-	// Output temporary files to local file system
-	if tempRecLength > 0 {
+		if redirect := viper.GetString("tls.redirectHTTP"); redirect != "" {
+			redirectServer := &http.Server{Addr: redirect, Handler: redirectToHTTPS(viper.GetString("port"))}
+			servers = append(servers, redirectServer)
+			go func() {
+				log.Printf("[INFO]: Redirecting HTTP on %v to HTTPS\n", redirect)
+				if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+					log.Printf("[ERROR]: HTTP redirect listener stopped: %v\n", err)
+				}
+			}()
+		}
+
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
 		go func() {
-			for {
-				writeMut.Lock()
-				writeTemporaryStorage(tempRecLength)
-				writeMut.Unlock()
+			if err := server.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
+				fail(err)
 			}
 		}()
-	} else {
-		log.Println("[WARN]: temp recording length set to 0; recording will not be saved to file system.")
 	}
 
-	// Purge any older temporary files (beyond the keep time)
-	if tempKeepTime > 0 {
-		go purgeTemporaryStorage(tempKeepTime)
-	} else {
-		log.Println("[WARN]: temp keep time set to 0; any recordings saved to file system will not be erased.")
+	// Run until signalled or until something fails
+	status := 0
+	select {
+	case sig := <-sigCh:
+		log.Printf("[INFO]: Received signal %v; finishing recordings...\n", sig)
+	case err := <-failures:
+		log.Printf("[ERROR]: %v\n", err)
+		status = 1
 	}
+	// A second signal kills GoCam outright if shutdown hangs
+	signal.Stop(sigCh)
 
-	// Spin up the controller server
-	http.HandleFunc("/health", HealthHandler)
-	http.HandleFunc("/api/power/off", PowerOffHandler)
-	http.HandleFunc("/api/power/on", PowerOnHandler)
-	http.HandleFunc("/api/power", GetPowerHandler)
-	http.HandleFunc("/cam", ServeCamera)
-	http.HandleFunc("/api/archives", ListArchivesHandler)
-	http.HandleFunc("/api/archives/delete", DeleteArchiveHandler)
+	// Stop capture first so every open clip is closed and playable
+	cancel()
+	for _, cam := range cameras {
+		cam.Close()
+	}
 
-	//http.Handle("/archives", http.FileServer(http.Dir("archive")))
-	http.Handle("/", http.StripPrefix(strings.TrimRight("/archives", "/"), http.FileServer(http.Dir("archive"))))
+	// Then let in-flight requests finish; live streams never do, so they
+	// are cut off once the timeout passes
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			srv.Close()
+		}
+	}
+	cancelShutdown()
 
-	log.Fatal(http.ListenAndServe(host, nil))
+	if err := eventLog.Close(); err != nil {
+		log.Printf("[ERROR]: Unable to close event log: %v\n", err)
+		status = 1
+	}
+	log.Println("Gocam shutting down...")
+	os.Exit(status)
 }
 
 
@@ -216,16 +362,13 @@ func HealthHandler(w http.ResponseWriter, request *http.Request) {
 }
 
 
-func PowerOffHandler(w http.ResponseWriter, request *http.Request) {
-	setupResponse(&w, request)
-	runMut.Lock()
+// primaryCamera is the camera behind the single-camera endpoints (/cam, /api/power, /api/archives).
+func primaryCamera() *Camera {
+	return cameras[0]
+}
 
-	// Shutdown the camera
-	isRunning = false
-	runMut.Unlock()
-	log.Println("Gocam powering off...")
 
-	data := PowerResponse{isRunning}
+func writeJSON(w http.ResponseWriter, data interface{}) {
 	js, err := json.Marshal(data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -236,56 +379,230 @@ func PowerOffHandler(w http.ResponseWriter, request *http.Request) {
 }
 
 
-func PowerOnHandler(w http.ResponseWriter, request *http.Request) {
+func setPower(w http.ResponseWriter, request *http.Request, cam *Camera, on bool) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "use POST to power the camera on or off", http.StatusMethodNotAllowed)
+		return
+	}
+	cam.SetRunning(on)
+	if on {
+		log.Printf("[%v] Gocam powering on...\n", cam.ID)
+	} else {
+		log.Printf("[%v] Gocam powering off...\n", cam.ID)
+	}
+	writeJSON(w, PowerResponse{cam.IsRunning()})
+}
+
+
+func PowerOffHandler(w http.ResponseWriter, request *http.Request) {
 	setupResponse(&w, request)
-	runMut.Lock()
+	setPower(w, request, primaryCamera(), false)
+}
 
-	// Poweron the camera
-	isRunning = true
-	runMut.Unlock()
-	log.Printf("Gocam powering on...\n")
 
-	data := PowerResponse{isRunning}
-	js, err := json.Marshal(data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(js)
-	}
+func PowerOnHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	setPower(w, request, primaryCamera(), true)
 }
 
 
 func GetPowerHandler(w http.ResponseWriter, request *http.Request) {
 	setupResponse(&w, request)
-	data := PowerResponse{isRunning}
-	js, err := json.Marshal(data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(js)
-	}
+	writeJSON(w, PowerResponse{primaryCamera().IsRunning()})
 }
 
 
+// ServeCamera streams /cam for the primary camera and /cam/{id} for any other.
 func ServeCamera(w http.ResponseWriter, request *http.Request) {
 	setupResponse(&w, request)
-	runMut.Lock()
-	r := isRunning
-	runMut.Unlock()
-	if !r {
+	cam := primaryCamera()
+	if id := strings.Trim(strings.TrimPrefix(request.URL.Path, "/cam"), "/"); id != "" {
+		cam = camerasByID[id]
+		if cam == nil {
+			http.NotFound(w, request)
+			return
+		}
+	}
+
+	if !cam.IsRunning() {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Camera is powered off currently."))
 	} else {
-		stream.ServeHTTP(w, request)
+		defer cam.metrics.ViewerConnected()()
+		cam.stream.ServeHTTP(w, request)
+	}
+}
+
+
+type CameraInfo struct {
+	ID         string
+	Name       string
+	Source     string
+	PowerOn    bool
+	Connection ConnectionState
+}
+
+func cameraInfo(cam *Camera) CameraInfo {
+	return CameraInfo{cam.ID, cam.Name, cam.SourceName(), cam.IsRunning(), cam.Connection()}
+}
+
+
+func ListCamerasHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	infos := []CameraInfo{}
+	for _, cam := range cameras {
+		infos = append(infos, cameraInfo(cam))
+	}
+	writeJSON(w, infos)
+}
+
+
+// CameraHandler routes /api/cameras/{id}[/power[/on|/off]|/archives[/{name}]|/record|/snapshot|/masks[/{name}]|/tracks].
+func CameraHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/cameras/"), "/"), "/")
+	cam := camerasByID[parts[0]]
+	if cam == nil {
+		http.NotFound(w, request)
+		return
+	}
+
+	action := strings.Join(parts[1:], "/")
+	switch {
+	case action == "power/on", action == "power/off", action == "record",
+		action == "snapshot" && request.Method == http.MethodPost,
+		strings.HasPrefix(action, "masks") && request.Method != http.MethodGet:
+		if !authenticator.authorize(w, request, RoleAdmin) {
+			return
+		}
 	}
+
+	switch action {
+	case "":
+		writeJSON(w, cameraInfo(cam))
+	case "power":
+		writeJSON(w, PowerResponse{cam.IsRunning()})
+	case "power/on":
+		setPower(w, request, cam, true)
+	case "power/off":
+		setPower(w, request, cam, false)
+	case "archives":
+		listArchives(w, cam)
+	case "record":
+		RecordHandler(w, request, cam)
+	case "snapshot":
+		snapshotHandler(w, request, cam)
+	case "masks":
+		masksHandler(w, request, cam, "")
+	case "tracks":
+		tracksHandler(w, request, cam)
+	default:
+		if len(parts) == 3 && parts[1] == "archives" {
+			archiveHandler(w, request, cam, parts[2])
+		} else if len(parts) == 3 && parts[1] == "masks" {
+			masksHandler(w, request, cam, parts[2])
+		} else {
+			http.NotFound(w, request)
+		}
+	}
+}
+
+
+type RecordResponse struct {
+	Recording bool
+	Until     time.Time
+}
+
+// RecordHandler starts a manual event clip: POST /api/cameras/{id}/record?duration=30s
+func RecordHandler(w http.ResponseWriter, request *http.Request, cam *Camera) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "use POST to start a recording", http.StatusMethodNotAllowed)
+		return
+	}
+	if !cam.config.Events.triggeredBy("manual") {
+		http.Error(w, "manual recording is not enabled in events.triggers", http.StatusConflict)
+		return
+	}
+
+	duration := cam.config.Events.PostRoll
+	if d := request.URL.Query().Get("duration"); d != "" {
+		parsed, err := time.ParseDuration(d)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration = parsed
+	}
+
+	until := cam.TriggerRecording(duration)
+	log.Printf("[INFO]: [%v] Manual recording requested until %v\n", cam.ID, until.Format(time.RFC3339))
+	writeJSON(w, RecordResponse{true, until})
+}
+
+
+type EventsResponse struct {
+	Total  int
+	Offset int
+	Limit  int
+	Events []Event
+}
+
+// ListEventsHandler serves GET /api/events?camera=&kind=&since=&until=&offset=&limit=
+// with since/until as RFC 3339 times. Events are returned newest first.
+func ListEventsHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	query := request.URL.Query()
+
+	filter := EventFilter{Camera: query.Get("camera"), Kind: query.Get("kind")}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %v: expected RFC 3339 time", bound.name), http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+
+	offset, limit := 0, 50
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 500 {
+			http.Error(w, "invalid limit: must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	total, events, err := eventLog.Query(filter, offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, EventsResponse{total, offset, limit, events})
 }
 
 
 func ListArchivesHandler(w http.ResponseWriter, request *http.Request) {
 	setupResponse(&w, request)
-	files, err := ioutil.ReadDir("archive")
+	listArchives(w, primaryCamera())
+}
+
+
+func listArchives(w http.ResponseWriter, cam *Camera) {
+	files, err := cam.archive.List()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
@@ -293,32 +610,78 @@ func ListArchivesHandler(w http.ResponseWriter, request *http.Request) {
 		for _, file := range files {
 			fileInfos = append(fileInfos, FileInfo{file,})
 		}
+		writeJSON(w, fileInfos)
+	}
+}
+
+
+// ArchiveHandler serves GET and DELETE /api/archives/{name} for the primary camera.
+func ArchiveHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	archiveHandler(w, request, primaryCamera(), strings.TrimPrefix(request.URL.Path, "/api/archives/"))
+}
 
-		js, encErr := json.Marshal(fileInfos)
-		if encErr != nil {
+
+// archiveHandler reports (GET) or deletes (DELETE) a single archive.
+func archiveHandler(w http.ResponseWriter, request *http.Request, cam *Camera, name string) {
+	switch request.Method {
+	case http.MethodGet:
+		info, err := cam.archive.Stat(name)
+		if err == ErrArchiveNotFound {
+			http.NotFound(w, request)
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		} else {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(js)
+			writeJSON(w, FileInfo{info})
+		}
+	case http.MethodDelete:
+		if !authenticator.authorize(w, request, RoleAdmin) {
+			return
 		}
+		err := cam.archive.Delete(name)
+		if err == ErrArchiveNotFound {
+			http.NotFound(w, request)
+		} else if err != nil {
+			log.Printf("[ERROR]: [%v] Unable to delete archive %s : %v", cam.ID, name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			log.Printf("[INFO]: [%v] Deleted archive %s\n", cam.ID, name)
+			w.WriteHeader(http.StatusOK)
+		}
+	default:
+		http.Error(w, "use GET or DELETE", http.StatusMethodNotAllowed)
 	}
 }
 
 
-func DeleteArchiveHandler(w http.ResponseWriter, request *http.Request) {
+// ServeArchive downloads /archives/{id}/{name}, or /archives/{name} from the primary camera.
+func ServeArchive(w http.ResponseWriter, request *http.Request) {
 	setupResponse(&w, request)
+	cam, name := primaryCamera(), strings.TrimPrefix(request.URL.Path, "/archives/")
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		cam, name = camerasByID[parts[0]], parts[1]
+	}
+	if cam == nil {
+		http.NotFound(w, request)
+		return
+	}
 
-	targetArchive := request.URL.Query().Get("archive")
+	file, err := cam.archive.Get(name)
+	if err == ErrArchiveNotFound {
+		http.NotFound(w, request)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
 
-	var archivePath string = filepath.Join("archive", targetArchive)
-	err := os.Remove(archivePath)
+	info, err := file.Stat()
 	if err != nil {
-		log.Printf("[ERROR]: Unable to delete archive %s : %v", archivePath, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else {
-		log.Printf("[INFO]: Deleted archive %s\n", archivePath)
-		w.WriteHeader(http.StatusOK)
+		return
 	}
+	http.ServeContent(w, request, name, info.ModTime(), file)
 }
 
 
@@ -337,100 +700,16 @@ func (f FileInfo) MarshalJSON() ([]byte, error) {
 }
 
 
-func detectFaces() {
-	mut.Lock()
-	defer mut.Unlock()
-
-	// Detect faces
-	rects := classifier.DetectMultiScale(img)
-	//log.Printf("found %d faces\n", len(rects))
-
-	// Draw a rectangle around each face on the original image,
-	// along with text identifying as "Human"
-	for _, r := range rects {
-		gocv.Rectangle(&img, r, blue, 3)
-		//size := gocv.GetTextSize("Human", gocv.FontHersheyPlain, 1.2, 2)
-		//pt := image.Pt(r.Min.X+(r.Min.X/2)-(size.X/2), r.Min.Y-2)
-		//gocv.PutText(&img, "Human", pt, gocv.FontHersheyPlain, 1.2, blue, 2)
-	}
-}
-
-func captureImage() {
-	mut.Lock()
-	defer mut.Unlock()
-
-	if ok := webcam.Read(&img); !ok {
-		log.Fatalf("Device closed: %v\n", deviceID)
-		os.Exit(-1)
-	}
-	if img.Empty() {
-		os.Exit(-1)
-	}
-}
-
 func setupResponse(w *http.ResponseWriter, req *http.Request) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-}
-
-func mjpegCapture() {
-	mut.Lock()
-	buf, _ := gocv.IMEncode(".jpg", img)
-	stream.UpdateJPEG(buf)
-	mut.Unlock()
-}
-
-func writeTemporaryStorage(interval time.Duration) {
-	runMut.Lock()
-	r := isRunning
-	runMut.Unlock()
-	if !r {
+	// Only echo back origins that are explicitly allowed; never a wildcard,
+	// since browsers send the session cookie along
+	(*w).Header().Set("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" || !contains(authenticator.allowedOrigins, origin) {
 		return
 	}
-
-	startTime := time.Now()
-	goalTime := startTime.Unix() + int64(interval.Seconds())
-	outputFileName := tempStoragePrefix + startTime.Format(time.RFC3339) + ".avi"
-	outputPath := filepath.Join("archive", outputFileName)
-
-	mut.Lock()
-	writer, err := gocv.VideoWriterFile(outputPath, "MJPG", 55, img.Cols(), img.Rows(), true)
-	mut.Unlock()
-	if err != nil {
-		log.Fatalf("error opening video writer device: %v\n", outputPath)
-	}
-	defer writer.Close()
-
-	for {
-		curTime := time.Now().Unix()
-		if curTime >= goalTime {
-			break
-		}
-
-		runMut.Lock()
-		r := isRunning
-		runMut.Unlock()
-		if r {
-			writer.Write(img)
-		}
-	}
-
-	log.Printf("%v seconds elapsed; ephemerally written to disk at %v\n", interval.Seconds(), outputPath)
-}
-
-func purgeTemporaryStorage(keepTime time.Duration) {
-	for {
-		cwd, _ := os.Getwd()
-		files, _ := ioutil.ReadDir(cwd)
-		for _, f := range files {
-			if !f.IsDir() && strings.HasPrefix(f.Name(), tempStoragePrefix) {
-				diff := time.Since(f.ModTime())
-				if diff >= keepTime {
-					os.Remove(f.Name())
-					log.Printf("Deleted legacy storage record %v", f.Name())
-				}
-			}
-		}
-	}
+	(*w).Header().Set("Access-Control-Allow-Origin", origin)
+	(*w).Header().Set("Access-Control-Allow-Credentials", "true")
+	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key")
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// Histogram counts observations into cumulative buckets, as Prometheus
+// expects them.
+type Histogram struct {
+	mut     sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// CameraMetrics are the counters one camera's pipeline updates as it runs.
+type CameraMetrics struct {
+	// 64-bit atomics must come first to stay aligned on 32-bit ARM
+	framesCaptured    uint64
+	readFailures      uint64
+	tempFramesWritten uint64
+	viewers           int64
+
+	// detectLatency is keyed by detector name, filled in by newCamera
+	detectLatency map[string]*Histogram
+	encodeLatency *Histogram
+
+	mut        sync.Mutex
+	detections map[string]uint64
+	fps        float64
+	fpsStart   time.Time
+	fpsFrames  int
+	lastFrame  time.Time
+}
+
+func newCameraMetrics() *CameraMetrics {
+	return &CameraMetrics{
+		detectLatency: map[string]*Histogram{},
+		encodeLatency: newHistogram(.001, .0025, .005, .01, .025, .05, .1),
+		detections:    map[string]uint64{},
+	}
+}
+
+func newDetectLatency() *Histogram {
+	return newHistogram(.005, .01, .025, .05, .1, .25, .5, 1, 2.5)
+}
+
+// FrameCaptured counts a frame and updates the frames-per-second estimate
+// about once a second.
+func (m *CameraMetrics) FrameCaptured(now time.Time) {
+	atomic.AddUint64(&m.framesCaptured, 1)
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.lastFrame = now
+	if m.fpsStart.IsZero() {
+		m.fpsStart = now
+	}
+	m.fpsFrames++
+	if elapsed := now.Sub(m.fpsStart); elapsed >= time.Second {
+		m.fps = float64(m.fpsFrames) / elapsed.Seconds()
+		m.fpsStart, m.fpsFrames = now, 0
+	}
+}
+
+// LastFrame is when the last frame was captured.
+func (m *CameraMetrics) LastFrame() time.Time {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.lastFrame
+}
+
+func (m *CameraMetrics) ReadFailed() {
+	atomic.AddUint64(&m.readFailures, 1)
+}
+
+func (m *CameraMetrics) TempFrameWritten() {
+	atomic.AddUint64(&m.tempFramesWritten, 1)
+}
+
+func (m *CameraMetrics) Detected(label string, n int) {
+	m.mut.Lock()
+	m.detections[label] += uint64(n)
+	m.mut.Unlock()
+}
+
+// ViewerConnected counts an MJPEG viewer; call the returned func when it leaves.
+func (m *CameraMetrics) ViewerConnected() func() {
+	atomic.AddInt64(&m.viewers, 1)
+	return func() { atomic.AddInt64(&m.viewers, -1) }
+}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw metricsWriter) sample(name string, labels []string, value float64) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mw.w.WriteByte('\n')
+}
+
+func (mw metricsWriter) histogram(name string, labels []string, h *Histogram) {
+	h.mut.Lock()
+	counts := append([]uint64{}, h.counts...)
+	sum, count := h.sum, h.count
+	h.mut.Unlock()
+
+	for i, bound := range h.buckets {
+		mw.sample(name+"_bucket", append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(counts[i]))
+	}
+	mw.sample(name+"_bucket", append(labels, "le", "+Inf"), float64(count))
+	mw.sample(name+"_sum", labels, sum)
+	mw.sample(name+"_count", labels, float64(count))
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeMetrics writes every gocam and Go runtime metric to out.
+func writeMetrics(out io.Writer) error {
+	mw := metricsWriter{bufio.NewWriter(out)}
+
+	perCamera := func(name, typ, help string, value func(cam *Camera) float64) {
+		mw.family(name, typ, help)
+		for _, cam := range cameras {
+			mw.sample(name, []string{"camera", cam.ID}, value(cam))
+		}
+	}
+	perCamera("gocam_camera_powered_on", "gauge", "Whether the camera is powered on.", func(cam *Camera) float64 {
+		return boolMetric(cam.IsRunning())
+	})
+	perCamera("gocam_camera_connected", "gauge", "Whether the camera's frame source is delivering frames.", func(cam *Camera) float64 {
+		return boolMetric(cam.Connection().Connected)
+	})
+	perCamera("gocam_camera_reconnects_total", "counter", "Times the frame source was reopened after failing.", func(cam *Camera) float64 {
+		return float64(cam.Connection().Reconnects)
+	})
+	perCamera("gocam_frames_captured_total", "counter", "Frames read from the frame source.", func(cam *Camera) float64 {
+		return float64(atomic.LoadUint64(&cam.metrics.framesCaptured))
+	})
+	perCamera("gocam_capture_fps", "gauge", "Frames captured per second over the last second or so.", func(cam *Camera) float64 {
+		cam.metrics.mut.Lock()
+		defer cam.metrics.mut.Unlock()
+		return cam.metrics.fps
+	})
+	perCamera("gocam_frame_read_failures_total", "counter", "Failed reads from the frame source.", func(cam *Camera) float64 {
+		return float64(atomic.LoadUint64(&cam.metrics.readFailures))
+	})
+	perCamera("gocam_mjpeg_viewers", "gauge", "Clients currently watching the MJPEG stream.", func(cam *Camera) float64 {
+		return float64(atomic.LoadInt64(&cam.metrics.viewers))
+	})
+	perCamera("gocam_tracks_active", "gauge", "Objects currently tracked.", func(cam *Camera) float64 {
+		if cam.tracker == nil {
+			return 0
+		}
+		return float64(len(cam.tracker.Active()))
+	})
+	perCamera("gocam_temp_frames_written_total", "counter", "Frames written to continuous TMP_ recordings.", func(cam *Camera) float64 {
+		return float64(atomic.LoadUint64(&cam.metrics.tempFramesWritten))
+	})
+
+	mw.family("gocam_detections_total", "counter", "Objects detected, by label.")
+	for _, cam := range cameras {
+		cam.metrics.mut.Lock()
+		labels := make([]string, 0, len(cam.metrics.detections))
+		for label := range cam.metrics.detections {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			mw.sample("gocam_detections_total", []string{"camera", cam.ID, "label", label}, float64(cam.metrics.detections[label]))
+		}
+		cam.metrics.mut.Unlock()
+	}
+
+	mw.family("gocam_detect_duration_seconds", "histogram", "Time spent running a detector on a frame.")
+	for _, cam := range cameras {
+		for _, d := range cam.detectors {
+			mw.histogram("gocam_detect_duration_seconds", []string{"camera", cam.ID, "detector", d.Name()}, cam.metrics.detectLatency[d.Name()])
+		}
+	}
+	mw.family("gocam_mjpeg_encode_duration_seconds", "histogram", "Time spent encoding a frame for the MJPEG stream.")
+	for _, cam := range cameras {
+		mw.histogram("gocam_mjpeg_encode_duration_seconds", []string{"camera", cam.ID}, cam.metrics.encodeLatency)
+	}
+
+	archiveBytes := map[string]int64{}
+	archiveFiles := map[string]int{}
+	for _, cam := range cameras {
+		files, err := cam.archive.List()
+		if err != nil {
+			log.Printf("[ERROR]: [%v] Unable to list archive for metrics: %v\n", cam.ID, err)
+			continue
+		}
+		for _, file := range files {
+			archiveBytes[cam.ID] += file.Size()
+		}
+		archiveFiles[cam.ID] = len(files)
+	}
+	perCamera("gocam_archive_bytes", "gauge", "Total size of the camera's archive folder.", func(cam *Camera) float64 {
+		return float64(archiveBytes[cam.ID])
+	})
+	perCamera("gocam_archive_files", "gauge", "Number of files in the camera's archive folder.", func(cam *Camera) float64 {
+		return float64(archiveFiles[cam.ID])
+	})
+
+	if free, total, err := diskSpace(archiveRoot); err == nil {
+		mw.family("gocam_disk_free_bytes", "gauge", "Free space on the file system holding the archive.")
+		mw.sample("gocam_disk_free_bytes", []string{"path", archiveRoot}, float64(free))
+		mw.family("gocam_disk_size_bytes", "gauge", "Size of the file system holding the archive.")
+		mw.sample("gocam_disk_size_bytes", []string{"path", archiveRoot}, float64(total))
+	}
+
+	mw.family("gocam_start_time_seconds", "gauge", "Start time of gocam since the Unix epoch.")
+	mw.sample("gocam_start_time_seconds", nil, float64(startTime.Unix()))
+
+	// Go runtime, named like the official client's collector
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	mw.family("go_info", "gauge", "Information about the Go environment.")
+	mw.sample("go_info", []string{"version", runtime.Version()}, 1)
+	mw.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	mw.sample("go_goroutines", nil, float64(runtime.NumGoroutine()))
+	mw.family("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	mw.sample("go_memstats_alloc_bytes", nil, float64(mem.Alloc))
+	mw.family("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	mw.sample("go_memstats_heap_inuse_bytes", nil, float64(mem.HeapInuse))
+	mw.family("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	mw.sample("go_memstats_sys_bytes", nil, float64(mem.Sys))
+	mw.family("go_memstats_gc_cpu_fraction", "gauge", "Fraction of CPU time used by the GC since the program started.")
+	mw.sample("go_memstats_gc_cpu_fraction", nil, mem.GCCPUFraction)
+	mw.family("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	mw.sample("go_gc_cycles_total", nil, float64(mem.NumGC))
+	mw.family("go_gc_pause_seconds_total", "counter", "Total time spent in GC stop-the-world pauses.")
+	mw.sample("go_gc_pause_seconds_total", nil, time.Duration(mem.PauseTotalNs).Seconds())
+
+	return mw.w.Flush()
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MetricsHandler serves GET /metrics in the Prometheus text format.
+func MetricsHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writeMetrics(w); err != nil {
+		log.Printf("[ERROR]: Unable to write metrics: %v\n", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 2, 5)
+	for _, v := range []float64{0.5, 1.5, 2, 10} {
+		h.Observe(v)
+	}
+
+	var buf bytes.Buffer
+	mw := metricsWriter{bufio.NewWriter(&buf)}
+	mw.histogram("op_seconds", []string{"camera", "front"}, h)
+	mw.w.Flush()
+
+	// Buckets are cumulative and the last one counts everything
+	want := `op_seconds_bucket{camera="front",le="1"} 1
+op_seconds_bucket{camera="front",le="2"} 3
+op_seconds_bucket{camera="front",le="5"} 3
+op_seconds_bucket{camera="front",le="+Inf"} 4
+op_seconds_sum{camera="front"} 14
+op_seconds_count{camera="front"} 4
+`
+	if buf.String() != want {
+		t.Errorf("histogram written as\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"front", "front"},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\archive`, `C:\\archive`},
+		{"two\nlines", `two\nlines`},
+	}
+	for _, tt := range tests {
+		if got := escapeLabel(tt.in); got != tt.want {
+			t.Errorf("escapeLabel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+var (
+	metricsComment = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	metricsSample  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*",?)*\})? (\S+)$`)
+	histogramPart  = regexp.MustCompile(`_(bucket|sum|count)$`)
+)
+
+func TestWriteMetrics(t *testing.T) {
+	front, back := newTestCamera(t, "front"), newTestCamera(t, "back")
+	useCameras(t, front, back)
+	front.SetRunning(true)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		front.metrics.FrameCaptured(now.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+	front.metrics.ReadFailed()
+	front.metrics.Detected("person", 2)
+	front.metrics.Detected("car", 1)
+	front.metrics.Detected("person", 1)
+	front.metrics.encodeLatency.Observe(0.003)
+	leave := back.metrics.ViewerConnected()
+	back.metrics.ViewerConnected()
+	leave()
+	path, err := front.archive.Create("TMP_1.avi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	// Every line is a HELP or TYPE comment or a sample of a declared family
+	typed := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if m := metricsComment.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				typed[m[2]] = m[3]
+			}
+			continue
+		}
+		m := metricsSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("invalid line %q", line)
+			continue
+		}
+		family := m[1]
+		if typed[family] == "" {
+			family = histogramPart.ReplaceAllString(family, "")
+		}
+		if typed[family] == "" {
+			t.Errorf("sample %q comes before its TYPE", line)
+		}
+	}
+
+	for _, want := range []string{
+		"# TYPE gocam_frames_captured_total counter\n",
+		`gocam_frames_captured_total{camera="front"} 3` + "\n",
+		`gocam_frames_captured_total{camera="back"} 0` + "\n",
+		`gocam_frame_read_failures_total{camera="front"} 1` + "\n",
+		`gocam_camera_powered_on{camera="front"} 1` + "\n",
+		`gocam_camera_powered_on{camera="back"} 0` + "\n",
+		`gocam_mjpeg_viewers{camera="back"} 1` + "\n",
+		// Labels are sorted so the output is stable
+		`gocam_detections_total{camera="front",label="car"} 1` + "\n" +
+			`gocam_detections_total{camera="front",label="person"} 3` + "\n",
+		`gocam_mjpeg_encode_duration_seconds_bucket{camera="front",le="0.005"} 1` + "\n",
+		`gocam_mjpeg_encode_duration_seconds_count{camera="front"} 1` + "\n",
+		`gocam_archive_bytes{camera="front"} 1000` + "\n",
+		`gocam_archive_files{camera="front"} 1` + "\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// ModeConfig is one entry of the modes: section, e.g. home, away or night.
+// Lists take "all" or "none" as well as names.
+type ModeConfig struct {
+	// Detectors that run: motion, face.
+	Detectors []string
+	// ContinuousRecording writes TMP_ clips; EventRecording writes EVT_
+	// clips for detections. Manual recordings are always allowed.
+	ContinuousRecording bool
+	EventRecording      bool
+	// Notifications lists the event kinds sent to webhooks.
+	Notifications []string
+}
+
+// allows reports whether a mode list includes name.
+func allows(list []string, name string) bool {
+	return contains(list, "all") || contains(list, name)
+}
+
+// ArmingModes holds the configured modes and the one currently active,
+// which is kept in the state file so it survives restarts.
+type ArmingModes struct {
+	mut     sync.Mutex
+	current string
+	modes   map[string]ModeConfig
+}
+
+var arming = &ArmingModes{modes: map[string]ModeConfig{}}
+
+// defaultMode is what runs when no modes are configured: everything on.
+var defaultMode = ModeConfig{
+	Detectors:           []string{"all"},
+	ContinuousRecording: true,
+	EventRecording:      true,
+	Notifications:       []string{"all"},
+}
+
+func loadArmingModes(saved string) (*ArmingModes, error) {
+	a := &ArmingModes{modes: map[string]ModeConfig{}}
+	for name, entry := range viper.GetStringMap("modes") {
+		// Start from the default so keys left out keep everything on. The
+		// lists start nil: decoding into defaultMode's slices would write
+		// through to it, and an empty list must stay empty.
+		mode := defaultMode
+		mode.Detectors, mode.Notifications = nil, nil
+		if err := mapstructure.WeakDecode(entry, &mode); err != nil {
+			return nil, fmt.Errorf("modes.%v: %v", name, err)
+		}
+		keys := viper.Sub("modes." + name)
+		if keys == nil || !keys.IsSet("detectors") {
+			mode.Detectors = append([]string{}, defaultMode.Detectors...)
+		}
+		if keys == nil || !keys.IsSet("notifications") {
+			mode.Notifications = append([]string{}, defaultMode.Notifications...)
+		}
+		a.modes[name] = mode
+	}
+	if len(a.modes) == 0 {
+		return a, nil
+	}
+
+	a.current = viper.GetString("defaultMode")
+	if _, ok := a.modes[saved]; ok {
+		a.current = saved
+	} else if saved != "" {
+		log.Printf("[WARN]: Saved mode %q is no longer configured; using %q.\n", saved, a.current)
+	}
+	if _, ok := a.modes[a.current]; !ok {
+		return nil, fmt.Errorf("defaultMode %q is not one of the configured modes", a.current)
+	}
+	log.Printf("[INFO]: Arming mode is %v.\n", a.current)
+	return a, nil
+}
+
+// Current returns the active mode's name and settings.
+func (a *ArmingModes) Current() (string, ModeConfig) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.current == "" {
+		return "", defaultMode
+	}
+	return a.current, a.modes[a.current]
+}
+
+// Set switches to the named mode and saves it in the state file.
+func (a *ArmingModes) Set(name string) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if _, ok := a.modes[name]; !ok {
+		return fmt.Errorf("unknown mode %q", name)
+	}
+	if err := state.Update(func(s *PersistentState) { s.Mode = name }); err != nil {
+		return err
+	}
+	log.Printf("[INFO]: Arming mode changed from %v to %v.\n", a.current, name)
+	a.current = name
+	return nil
+}
+
+func (a *ArmingModes) names() []string {
+	names := []string{}
+	for name := range a.modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type ModeResponse struct {
+	Mode     string
+	Settings ModeConfig
+	Modes    map[string]ModeConfig
+}
+
+type ModeRequest struct {
+	Mode string
+}
+
+// ModeHandler serves GET /api/mode and switches modes on
+// PUT /api/mode {"Mode": "home"}.
+func ModeHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !authenticator.authorize(w, request, RoleAdmin) {
+			return
+		}
+		var req ModeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, request.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "invalid mode request", http.StatusBadRequest)
+			return
+		}
+		if _, ok := arming.modes[req.Mode]; !ok {
+			http.Error(w, fmt.Sprintf("unknown mode %q (expected one of %v)", req.Mode, arming.names()), http.StatusBadRequest)
+			return
+		}
+		if err := arming.Set(req.Mode); err != nil {
+			log.Printf("[ERROR]: Unable to save mode: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "use GET or PUT for the mode", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, settings := arming.Current()
+	writeJSON(w, ModeResponse{name, settings, arming.modes})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testModes = `
+defaultMode: home
+modes:
+  home:
+    detectors: [face]
+    continuousRecording: false
+    notifications: []
+  away:
+    eventRecording: true
+  night:
+    detectors: none
+    notifications: [person, motion]
+`
+
+// useConfig loads yaml as the configuration file for one test.
+func useConfig(t *testing.T, yaml string) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useStateFile opens path as the global state store for one test.
+func useStateFile(t *testing.T, path string) {
+	t.Helper()
+	previous := state
+	s, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state = s
+	t.Cleanup(func() { state = previous })
+}
+
+func TestLoadArmingModes(t *testing.T) {
+	useConfig(t, testModes)
+	a, err := loadArmingModes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want ModeConfig
+	}{
+		// Lists left out keep the default, but an explicit empty list stays empty
+		{"home", ModeConfig{Detectors: []string{"face"}, EventRecording: true, Notifications: nil}},
+		{"away", ModeConfig{Detectors: []string{"all"}, ContinuousRecording: true, EventRecording: true, Notifications: []string{"all"}}},
+		{"night", ModeConfig{Detectors: []string{"none"}, ContinuousRecording: true, EventRecording: true, Notifications: []string{"person", "motion"}}},
+	}
+	for _, tt := range tests {
+		if got := a.modes[tt.name]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mode %v = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if name, _ := a.Current(); name != "home" {
+		t.Errorf("current mode %q, want defaultMode home", name)
+	}
+	if !reflect.DeepEqual(defaultMode.Detectors, []string{"all"}) || !reflect.DeepEqual(defaultMode.Notifications, []string{"all"}) {
+		t.Errorf("loading modes changed the default mode to %+v", defaultMode)
+	}
+}
+
+func TestArmingModesPersist(t *testing.T) {
+	useConfig(t, testModes)
+	path := filepath.Join(t.TempDir(), "state", "state.json")
+	useStateFile(t, path)
+
+	a, err := loadArmingModes(state.Get().Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set("night"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set("sleeping"); err == nil {
+		t.Errorf("Set accepted an unknown mode")
+	}
+
+	// A restart picks up the mode saved in the state file
+	useStateFile(t, path)
+	a, err = loadArmingModes(state.Get().Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, mode := a.Current(); name != "night" || !reflect.DeepEqual(mode.Detectors, []string{"none"}) {
+		t.Errorf("mode after restart = %v %+v, want night", name, mode)
+	}
+
+	// A saved mode that was since removed falls back to defaultMode
+	useConfig(t, strings.Replace(testModes, "night:", "evening:", 1))
+	a, err = loadArmingModes(state.Get().Mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := a.Current(); name != "home" {
+		t.Errorf("mode after night was removed = %v, want home", name)
+	}
+}
+
+func TestLoadArmingModesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"unknown default", "defaultMode: party\nmodes:\n  home: {}\n"},
+		{"no default", "modes:\n  home: {}\n"},
+		{"bad setting", "defaultMode: home\nmodes:\n  home:\n    eventRecording: sometimes\n"},
+	}
+	for _, tt := range tests {
+		useConfig(t, tt.yaml)
+		if _, err := loadArmingModes(""); err == nil {
+			t.Errorf("%v: loadArmingModes() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestLoadArmingModesNone(t *testing.T) {
+	useConfig(t, "port: 5000\n")
+	a, err := loadArmingModes("away")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, mode := a.Current(); name != "" || !reflect.DeepEqual(mode, defaultMode) {
+		t.Errorf("Current() = %q %+v without modes, want the default mode", name, mode)
+	}
+}
+
+func TestModeHandler(t *testing.T) {
+	useAuthenticator(t, &Authenticator{})
+	useConfig(t, testModes)
+	useStateFile(t, filepath.Join(t.TempDir(), "state.json"))
+	a, err := loadArmingModes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := arming
+	arming = a
+	t.Cleanup(func() { arming = previous })
+
+	tests := []struct {
+		method, body string
+		want         int
+		mode         string
+	}{
+		{"GET", "", http.StatusOK, "home"},
+		{"PUT", `{"Mode": "away"}`, http.StatusOK, "away"},
+		{"PUT", `{"Mode": "party"}`, http.StatusBadRequest, "away"},
+		{"PUT", `away`, http.StatusBadRequest, "away"},
+		{"POST", `{"Mode": "night"}`, http.StatusMethodNotAllowed, "away"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		ModeHandler(w, httptest.NewRequest(tt.method, "/api/mode", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%v %v: status %d, want %d", tt.method, tt.body, w.Code, tt.want)
+		}
+		if name, _ := arming.Current(); name != tt.mode {
+			t.Errorf("%v %v: mode %v, want %v", tt.method, tt.body, name, tt.mode)
+		}
+	}
+	if saved := state.Get().Mode; saved != "away" {
+		t.Errorf("saved mode %q, want away", saved)
+	}
+}
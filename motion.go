@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+// MotionConfig tunes the motion detector of a camera.
+type MotionConfig struct {
+	// Method is "diff" (running-average frame differencing) or "mog2"
+	// (gocv's BackgroundSubtractorMOG2).
+	Method string
+	// Sensitivity in [0, 1]; higher values react to smaller brightness changes.
+	// Only used by the diff method, MOG2 adapts its own threshold.
+	Sensitivity float64
+	// MinArea is the smallest changed region, in pixels, that counts as motion.
+	MinArea float64
+}
+
+// MotionDetector reports whether a frame differs enough from the recent
+// background to count as motion.
+type MotionDetector struct {
+	config MotionConfig
+
+	mog2       gocv.BackgroundSubtractorMOG2
+	background gocv.Mat
+	gray       gocv.Mat
+	delta      gocv.Mat
+	kernel     gocv.Mat
+}
+
+func newMotionDetector(cfg MotionConfig) *MotionDetector {
+	d := &MotionDetector{
+		config:     cfg,
+		background: gocv.NewMat(),
+		gray:       gocv.NewMat(),
+		delta:      gocv.NewMat(),
+		kernel:     gocv.GetStructuringElement(gocv.MorphRect, image.Pt(3, 3)),
+	}
+	if cfg.Method == "mog2" {
+		d.mog2 = gocv.NewBackgroundSubtractorMOG2()
+	}
+	return d
+}
+
+// Detect returns the bounding boxes of every moving region at least MinArea in size.
+func (d *MotionDetector) Detect(img gocv.Mat) []image.Rectangle {
+	gocv.CvtColor(img, &d.gray, gocv.ColorBGRToGray)
+	gocv.GaussianBlur(d.gray, &d.gray, image.Pt(21, 21), 0, 0, gocv.BorderDefault)
+
+	if d.config.Method == "mog2" {
+		d.mog2.Apply(d.gray, &d.delta)
+		// MOG2 marks shadows as 127; only keep definite foreground
+		gocv.Threshold(d.delta, &d.delta, 200, 255, gocv.ThresholdBinary)
+	} else {
+		// Start the background from the first frame, then let it drift slowly
+		// so lighting changes are absorbed instead of reported
+		if d.background.Empty() || d.background.Rows() != d.gray.Rows() || d.background.Cols() != d.gray.Cols() {
+			d.gray.CopyTo(&d.background)
+			return nil
+		}
+		gocv.AbsDiff(d.background, d.gray, &d.delta)
+		gocv.AddWeighted(d.background, 0.95, d.gray, 0.05, 0, &d.background)
+
+		threshold := float32(5 + (1-d.config.Sensitivity)*95)
+		gocv.Threshold(d.delta, &d.delta, threshold, 255, gocv.ThresholdBinary)
+	}
+	gocv.Dilate(d.delta, &d.delta, d.kernel)
+
+	regions := []image.Rectangle{}
+	for _, contour := range gocv.FindContours(d.delta, gocv.RetrievalExternal, gocv.ChainApproxSimple) {
+		if gocv.ContourArea(contour) >= d.config.MinArea {
+			regions = append(regions, gocv.BoundingRect(contour))
+		}
+	}
+	return regions
+}
+
+func (d *MotionDetector) Close() {
+	if d.config.Method == "mog2" {
+		d.mog2.Close()
+	}
+	d.background.Close()
+	d.gray.Close()
+	d.delta.Close()
+	d.kernel.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// OverlayConfig controls what is burned into the stream, recordings and
+// snapshots. Detectors always see the frame without overlays.
+type OverlayConfig struct {
+	Timestamp bool
+	// TimestampFormat is a Go time layout.
+	TimestampFormat string
+	CameraName      bool
+	// Text is a custom line, e.g. an address or a case number.
+	Text string
+	// Position of the text block: top-left, top-right, bottom-left or bottom-right.
+	Position string
+	// Scale multiplies the font size, which otherwise follows the frame width.
+	Scale float64
+	// Boxes draws detection boxes with their label and confidence.
+	Boxes bool
+	// Colors are "#rrggbb" per detection label; "default" covers the rest.
+	Colors map[string]string
+}
+
+var overlayPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right"}
+
+// Overlay draws an OverlayConfig onto frames.
+type Overlay struct {
+	config OverlayConfig
+	name   string
+	colors map[string]color.RGBA
+}
+
+func newOverlay(cfg OverlayConfig, cameraName string) (*Overlay, error) {
+	if !contains(overlayPositions, cfg.Position) {
+		return nil, fmt.Errorf("overlay.position must be one of %v", strings.Join(overlayPositions, ", "))
+	}
+	if cfg.Scale <= 0 {
+		return nil, fmt.Errorf("overlay.scale must be positive")
+	}
+	o := &Overlay{config: cfg, name: cameraName, colors: map[string]color.RGBA{
+		"default": {G: 255, A: 255},
+		"face":    {B: 255, A: 255},
+	}}
+	for label, hex := range cfg.Colors {
+		c, err := parseColor(hex)
+		if err != nil {
+			return nil, fmt.Errorf("overlay.colors.%v: %v", label, err)
+		}
+		o.colors[strings.ToLower(label)] = c
+	}
+	return o, nil
+}
+
+// parseColor parses "#rrggbb".
+func parseColor(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 255}
+	if n, err := fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil || n != 3 || len(s) != 7 {
+		return c, fmt.Errorf("invalid colour %q (expected #rrggbb)", s)
+	}
+	return c, nil
+}
+
+// SetDefaultColor colours a label's boxes unless overlay.colors already does.
+func (o *Overlay) SetDefaultColor(label string, c color.RGBA) {
+	for configured := range o.config.Colors {
+		if strings.EqualFold(configured, label) {
+			return
+		}
+	}
+	o.colors[strings.ToLower(label)] = c
+}
+
+func (o *Overlay) color(label string) color.RGBA {
+	if c, ok := o.colors[strings.ToLower(label)]; ok {
+		return c
+	}
+	return o.colors["default"]
+}
+
+// fontScale sizes text relative to a 640 pixel wide frame.
+func (o *Overlay) fontScale(img *gocv.Mat) float64 {
+	return o.config.Scale * float64(img.Cols()) / 640 * 0.6
+}
+
+// DrawText burns the timestamp, camera name and custom text into img.
+func (o *Overlay) DrawText(img *gocv.Mat, now time.Time) {
+	lines := []string{}
+	if o.config.Timestamp {
+		lines = append(lines, now.Format(o.config.TimestampFormat))
+	}
+	if o.config.CameraName {
+		lines = append(lines, o.name)
+	}
+	if o.config.Text != "" {
+		lines = append(lines, o.config.Text)
+	}
+	if len(lines) == 0 || img.Empty() {
+		return
+	}
+
+	scale := o.fontScale(img)
+	thickness := maxInt(1, int(scale*2))
+	margin := maxInt(4, int(scale*10))
+	sizes := make([]image.Point, len(lines))
+	width, height := 0, 0
+	for i, line := range lines {
+		sizes[i] = gocv.GetTextSize(line, gocv.FontHersheySimplex, scale, thickness)
+		width = maxInt(width, sizes[i].X)
+		height += sizes[i].Y + margin
+	}
+
+	// Place the block in its corner on a dark background so it stays legible
+	x, y := margin, margin
+	if strings.HasSuffix(o.config.Position, "right") {
+		x = img.Cols() - width - margin
+	}
+	if strings.HasPrefix(o.config.Position, "bottom") {
+		y = img.Rows() - height - margin
+	}
+	background := image.Rect(x-margin/2, y-margin/2, x+width+margin/2, y+height)
+	gocv.Rectangle(img, background, color.RGBA{A: 255}, -1)
+	for i, line := range lines {
+		y += sizes[i].Y
+		gocv.PutText(img, line, image.Pt(x, y), gocv.FontHersheySimplex, scale, color.RGBA{R: 255, G: 255, B: 255, A: 255}, thickness)
+		y += margin
+	}
+}
+
+// DrawDetections outlines each detection with its label, confidence and
+// zone in the label's colour.
+func (o *Overlay) DrawDetections(img *gocv.Mat, detections []Detection) {
+	if !o.config.Boxes {
+		return
+	}
+	scale := o.fontScale(img) * 0.8
+	thickness := maxInt(1, int(scale*2))
+	for _, d := range detections {
+		c := o.color(d.Label)
+		gocv.Rectangle(img, d.Box, c, maxInt(2, thickness+1))
+
+		label := d.Label
+		if d.Confidence > 0 {
+			label += fmt.Sprintf(" %.0f%%", d.Confidence*100)
+		}
+		if d.Track != 0 {
+			label += fmt.Sprintf(" #%d", d.Track)
+		}
+		if d.Zone != "" {
+			label += " @" + d.Zone
+		}
+		size := gocv.GetTextSize(label, gocv.FontHersheySimplex, scale, thickness)
+		// Above the box, or inside it when the box touches the top edge
+		top := d.Box.Min.Y - size.Y - 6
+		if top < 0 {
+			top = d.Box.Min.Y
+		}
+		gocv.Rectangle(img, image.Rect(d.Box.Min.X, top, d.Box.Min.X+size.X+6, top+size.Y+6), c, -1)
+		gocv.PutText(img, label, image.Pt(d.Box.Min.X+3, top+size.Y+3), gocv.FontHersheySimplex, scale, textColor(c), thickness)
+	}
+}
+
+// textColor is black or white, whichever reads better on background.
+func textColor(background color.RGBA) color.RGBA {
+	if 0.299*float64(background.R)+0.587*float64(background.G)+0.114*float64(background.B) < 128 {
+		return color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	}
+	return color.RGBA{A: 255}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+var errMaskNotFound = errors.New("mask not found")
+
+// PrivacyMask hides a polygon of the frame before it is streamed, recorded,
+// snapshotted or analysed. Points are normalized to 0..1 of the frame's
+// width and height so masks survive resolution changes.
+type PrivacyMask struct {
+	Name   string
+	Points [][2]float64
+	// Style is "black" (default) or "pixelate".
+	Style string
+	// Configured masks come from the configuration file and cannot be
+	// deleted through the API.
+	Configured bool `json:",omitempty"`
+}
+
+func (m *PrivacyMask) validate() error {
+	if !validCameraID(m.Name) {
+		return fmt.Errorf("invalid mask name %q: use letters, digits, - and _", m.Name)
+	}
+	if len(m.Points) < 3 {
+		return fmt.Errorf("mask %v needs at least 3 points", m.Name)
+	}
+	for _, p := range m.Points {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return fmt.Errorf("mask %v: points must be between 0 and 1", m.Name)
+		}
+	}
+	if m.Style == "" {
+		m.Style = "black"
+	}
+	if m.Style != "black" && m.Style != "pixelate" {
+		return fmt.Errorf("mask %v: style must be black or pixelate", m.Name)
+	}
+	return nil
+}
+
+// polygon scales the mask to a cols x rows frame.
+func (m PrivacyMask) polygon(cols, rows int) []image.Point {
+	pts := make([]image.Point, len(m.Points))
+	for i, p := range m.Points {
+		pts[i] = image.Pt(int(p[0]*float64(cols)+0.5), int(p[1]*float64(rows)+0.5))
+	}
+	return pts
+}
+
+// MaskSet is one camera's privacy masks. Masks added through the API are
+// saved in the state file.
+type MaskSet struct {
+	camera string
+	mut    sync.Mutex
+	masks  []PrivacyMask
+
+	// pixelMask is 255 inside the pixelated masks, rebuilt when the masks
+	// or the frame size change
+	pixelMask gocv.Mat
+	pixelSize image.Point
+}
+
+func newMaskSet(camera string, configured, saved []PrivacyMask) (*MaskSet, error) {
+	set := &MaskSet{camera: camera, pixelMask: gocv.NewMat()}
+	for _, mask := range configured {
+		mask.Configured = true
+		if err := set.add(mask); err != nil {
+			return nil, err
+		}
+	}
+	for _, mask := range saved {
+		mask.Configured = false
+		if err := set.add(mask); err != nil {
+			return nil, fmt.Errorf("saved mask: %v", err)
+		}
+	}
+	return set, nil
+}
+
+func (s *MaskSet) add(mask PrivacyMask) error {
+	if err := mask.validate(); err != nil {
+		return err
+	}
+	for _, m := range s.masks {
+		if m.Name == mask.Name {
+			return fmt.Errorf("mask %v already exists", mask.Name)
+		}
+	}
+	s.masks = append(s.masks, mask)
+	s.pixelSize = image.Point{}
+	return nil
+}
+
+func (s *MaskSet) List() []PrivacyMask {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]PrivacyMask{}, s.masks...)
+}
+
+// Add validates and saves a new mask.
+func (s *MaskSet) Add(mask PrivacyMask) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	mask.Configured = false
+	if err := s.add(mask); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.masks = s.masks[:len(s.masks)-1]
+		return err
+	}
+	return nil
+}
+
+// Delete removes a mask that was added through the API.
+func (s *MaskSet) Delete(name string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for i, m := range s.masks {
+		if m.Name != name {
+			continue
+		}
+		if m.Configured {
+			return fmt.Errorf("mask %v is defined in the configuration file", name)
+		}
+		previous := s.masks
+		s.masks = append(append([]PrivacyMask{}, s.masks[:i]...), s.masks[i+1:]...)
+		if err := s.save(); err != nil {
+			s.masks = previous
+			return err
+		}
+		s.pixelSize = image.Point{}
+		return nil
+	}
+	return errMaskNotFound
+}
+
+func (s *MaskSet) save() error {
+	saved := []PrivacyMask{}
+	for _, m := range s.masks {
+		if !m.Configured {
+			saved = append(saved, m)
+		}
+	}
+	return state.Update(func(ps *PersistentState) {
+		if ps.Masks == nil {
+			ps.Masks = map[string][]PrivacyMask{}
+		}
+		ps.Masks[s.camera] = saved
+	})
+}
+
+// Apply hides every mask on img in place.
+func (s *MaskSet) Apply(img *gocv.Mat) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(s.masks) == 0 || img.Empty() {
+		return
+	}
+
+	cols, rows := img.Cols(), img.Rows()
+	black := [][]image.Point{}
+	pixelate := [][]image.Point{}
+	for _, m := range s.masks {
+		if m.Style == "pixelate" {
+			pixelate = append(pixelate, m.polygon(cols, rows))
+		} else {
+			black = append(black, m.polygon(cols, rows))
+		}
+	}
+
+	if len(pixelate) > 0 {
+		if s.pixelSize != image.Pt(cols, rows) {
+			s.pixelMask.Close()
+			s.pixelMask = gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV8UC1)
+			s.pixelMask.SetTo(gocv.NewScalar(0, 0, 0, 0))
+			gocv.FillPoly(&s.pixelMask, pixelate, color.RGBA{255, 255, 255, 255})
+			s.pixelSize = image.Pt(cols, rows)
+		}
+
+		// Scale down and back up to get 16 pixel blocks
+		small := gocv.NewMat()
+		blocks := gocv.NewMat()
+		gocv.Resize(*img, &small, image.Pt(maxInt(1, cols/16), maxInt(1, rows/16)), 0, 0, gocv.InterpolationArea)
+		gocv.Resize(small, &blocks, image.Pt(cols, rows), 0, 0, gocv.InterpolationNearestNeighbor)
+		blocks.CopyToWithMask(img, s.pixelMask)
+		small.Close()
+		blocks.Close()
+	}
+	if len(black) > 0 {
+		gocv.FillPoly(img, black, color.RGBA{0, 0, 0, 255})
+	}
+}
+
+func (s *MaskSet) Close() {
+	s.mut.Lock()
+	s.pixelMask.Close()
+	s.mut.Unlock()
+}
+
+// masksHandler serves the masks of one camera:
+//
+//	GET    /api/cameras/{id}/masks
+//	POST   /api/cameras/{id}/masks {"Name": "window", "Points": [[0.1, 0.1], ...], "Style": "pixelate"}
+//	DELETE /api/cameras/{id}/masks/{name}
+func masksHandler(w http.ResponseWriter, request *http.Request, cam *Camera, name string) {
+	switch {
+	case name == "" && request.Method == http.MethodGet:
+		writeJSON(w, cam.masks.List())
+	case name == "" && request.Method == http.MethodPost:
+		var mask PrivacyMask
+		if err := json.NewDecoder(http.MaxBytesReader(w, request.Body, 64*1024)).Decode(&mask); err != nil {
+			http.Error(w, "invalid mask: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cam.masks.Add(mask); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, cam.masks.List())
+	case name != "" && request.Method == http.MethodDelete:
+		err := cam.masks.Delete(name)
+		if err == errMaskNotFound {
+			http.NotFound(w, request)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "use GET or POST on masks and DELETE on masks/{name}", http.StatusMethodNotAllowed)
+	}
+}
+
+// MasksHandler serves /api/masks[/{name}] for the primary camera.
+func MasksHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	if request.Method != http.MethodGet && !authenticator.authorize(w, request, RoleAdmin) {
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/masks"), "/")
+	masksHandler(w, request, primaryCamera(), name)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"image"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestPrivacyMaskValidate(t *testing.T) {
+	square := [][2]float64{{0, 0}, {0.5, 0}, {0.5, 0.5}, {0, 0.5}}
+	tests := []struct {
+		name string
+		mask PrivacyMask
+		// style is the style after validation, or empty for an invalid mask
+		style string
+	}{
+		{"default style", PrivacyMask{Name: "door", Points: square}, "black"},
+		{"pixelate", PrivacyMask{Name: "door", Points: square, Style: "pixelate"}, "pixelate"},
+		{"whole frame", PrivacyMask{Name: "all", Points: [][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}}}, "black"},
+		{"no name", PrivacyMask{Points: square}, ""},
+		{"name with a space", PrivacyMask{Name: "front door", Points: square}, ""},
+		{"two points", PrivacyMask{Name: "line", Points: square[:2]}, ""},
+		{"outside the frame", PrivacyMask{Name: "door", Points: [][2]float64{{0, 0}, {1.5, 0}, {1, 1}}}, ""},
+		{"negative", PrivacyMask{Name: "door", Points: [][2]float64{{0, -0.1}, {1, 0}, {1, 1}}}, ""},
+		{"unknown style", PrivacyMask{Name: "door", Points: square, Style: "blur"}, ""},
+	}
+	for _, tt := range tests {
+		err := tt.mask.validate()
+		if tt.style == "" {
+			if err == nil {
+				t.Errorf("%v: validate() succeeded, want an error", tt.name)
+			}
+		} else if err != nil || tt.mask.Style != tt.style {
+			t.Errorf("%v: validate() = %v with style %q, want style %q", tt.name, err, tt.mask.Style, tt.style)
+		}
+	}
+}
+
+func TestPrivacyMaskPolygon(t *testing.T) {
+	mask := PrivacyMask{Points: [][2]float64{{0, 0}, {0.5, 0.25}, {1, 1}}}
+	want := []image.Point{{0, 0}, {320, 120}, {640, 480}}
+	got := mask.polygon(640, 480)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("polygon(640, 480) = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestMaskSetAddDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	useStateFile(t, path)
+	square := [][2]float64{{0, 0}, {0.5, 0}, {0.5, 0.5}}
+
+	// The Mat for pixelation is only needed by Apply
+	set := &MaskSet{camera: "front"}
+	if err := set.add(PrivacyMask{Name: "door", Points: square, Configured: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Add(PrivacyMask{Name: "window", Points: square, Style: "pixelate"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Add(PrivacyMask{Name: "window", Points: square}); err == nil {
+		t.Errorf("Add accepted a second mask called window")
+	}
+	if err := set.Add(PrivacyMask{Name: "door", Points: square}); err == nil {
+		t.Errorf("Add accepted a mask with the name of a configured one")
+	}
+	if err := set.Add(PrivacyMask{Name: "bad", Points: square[:2]}); err == nil {
+		t.Errorf("Add accepted an invalid mask")
+	}
+
+	// Only masks added through the API are saved, and they survive restarts
+	useStateFile(t, path)
+	if saved := state.Get().Masks["front"]; len(saved) != 1 || saved[0].Name != "window" || saved[0].Style != "pixelate" {
+		t.Errorf("saved masks = %+v, want only window", saved)
+	}
+
+	if err := set.Delete("door"); err == nil || err == errMaskNotFound {
+		t.Errorf("Delete of a configured mask = %v, want a refusal", err)
+	}
+	if err := set.Delete("garage"); err != errMaskNotFound {
+		t.Errorf("Delete of an unknown mask = %v, want errMaskNotFound", err)
+	}
+	if err := set.Delete("window"); err != nil {
+		t.Fatal(err)
+	}
+	if masks := set.List(); len(masks) != 1 || masks[0].Name != "door" {
+		t.Errorf("masks after Delete = %+v, want only door", masks)
+	}
+	useStateFile(t, path)
+	if saved := state.Get().Masks["front"]; len(saved) != 0 {
+		t.Errorf("saved masks after Delete = %+v", saved)
+	}
+}
+
+func TestNewMaskSet(t *testing.T) {
+	square := [][2]float64{{0, 0}, {0.5, 0}, {0.5, 0.5}}
+	set, err := newMaskSet("front", []PrivacyMask{{Name: "door", Points: square}}, []PrivacyMask{{Name: "window", Points: square, Configured: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	masks := set.List()
+	if len(masks) != 2 || !masks[0].Configured || masks[1].Configured {
+		t.Errorf("masks = %+v, want door from the configuration and window from the state file", masks)
+	}
+
+	if _, err := newMaskSet("front", []PrivacyMask{{Name: "door", Points: square}}, []PrivacyMask{{Name: "door", Points: square}}); err == nil {
+		t.Errorf("newMaskSet accepted a saved mask named like a configured one")
+	}
+}
+
+func TestMaskSetApply(t *testing.T) {
+	useStateFile(t, filepath.Join(t.TempDir(), "state.json"))
+	set, err := newMaskSet("front", []PrivacyMask{
+		// The left half is blacked out and the bottom right corner pixelated
+		{Name: "door", Points: [][2]float64{{0, 0}, {0.5, 0}, {0.5, 1}, {0, 1}}},
+		{Name: "window", Points: [][2]float64{{0.75, 0.75}, {1, 0.75}, {1, 1}, {0.75, 1}}, Style: "pixelate"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+
+	// A white frame with a dark spot inside the window
+	frame := func() gocv.Mat {
+		img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), 64, 64, gocv.MatTypeCV8UC3)
+		spot := img.Region(image.Rect(48, 48, 52, 52))
+		spot.SetTo(gocv.NewScalar(0, 0, 0, 0))
+		spot.Close()
+		return img
+	}
+	blue := func(img gocv.Mat, x, y int) uint8 { return img.GetUCharAt(y, 3*x) }
+
+	img := frame()
+	defer img.Close()
+	set.Apply(&img)
+	if v := blue(img, 10, 10); v != 0 {
+		t.Errorf("pixel inside the black mask = %d, want 0", v)
+	}
+	if v := blue(img, 40, 10); v != 255 {
+		t.Errorf("pixel outside the masks = %d, want 255", v)
+	}
+	// Pixelation averages the spot into its 16 pixel block
+	for _, p := range []image.Point{{50, 50}, {60, 60}} {
+		if v := blue(img, p.X, p.Y); v == 0 || v == 255 {
+			t.Errorf("pixel %v inside the pixelated mask = %d, want a blend", p, v)
+		}
+	}
+
+	// Without the window the spot is left alone
+	if err := set.Delete("window"); err != nil {
+		t.Fatal(err)
+	}
+	img2 := frame()
+	defer img2.Close()
+	set.Apply(&img2)
+	if v := blue(img2, 50, 50); v != 0 {
+		t.Errorf("spot after the pixelated mask was deleted = %d, want 0", v)
+	}
+}
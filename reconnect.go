@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ReconnectConfig controls how a camera whose frame source fails is reopened.
+type ReconnectConfig struct {
+	// InitialBackoff is the wait before the first attempt; it doubles after
+	// every failed attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// ConnectionState describes whether a camera is currently delivering frames.
+type ConnectionState struct {
+	Connected bool
+	// Since is when the camera last connected or disconnected.
+	Since      time.Time
+	LastError  string `json:",omitempty"`
+	Reconnects int
+}
+
+func (cam *Camera) Connection() ConnectionState {
+	cam.runMut.Lock()
+	defer cam.runMut.Unlock()
+	return cam.connection
+}
+
+func (cam *Camera) setConnected(connected bool, err error) {
+	cam.runMut.Lock()
+	defer cam.runMut.Unlock()
+	if connected && !cam.connection.Connected && !cam.connection.Since.IsZero() {
+		cam.connection.Reconnects++
+	}
+	cam.connection.Connected = connected
+	cam.connection.Since = time.Now()
+	if err != nil {
+		cam.connection.LastError = err.Error()
+	}
+}
+
+// SourceName describes the frame source without any credentials.
+func (cam *Camera) SourceName() string {
+	cam.runMut.Lock()
+	defer cam.runMut.Unlock()
+	return cam.sourceName
+}
+
+// reconnect marks the camera offline after a failed read and keeps trying
+// to reopen its frame source, with exponential backoff, until it delivers
+// a frame again or ctx is cancelled. Viewers see a placeholder frame in
+// the meantime; archives and the rest of the API stay available.
+func (cam *Camera) reconnect(ctx context.Context, cause error) {
+	log.Printf("[WARN]: [%v] Frame source %v failed: %v; reconnecting.\n", cam.ID, cam.SourceName(), cause)
+	cam.setConnected(false, cause)
+
+	// Close any event clip now rather than padding it with a frozen frame
+	cam.mut.Lock()
+	cam.recorder.Close()
+	cam.closeSource()
+	cam.mut.Unlock()
+
+	placeholder := cam.offlineFrame()
+	backoff := cam.config.Reconnect.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if !cam.waitOffline(ctx, backoff, placeholder) {
+			return
+		}
+
+		err := cam.reopenSource()
+		if err == nil {
+			log.Printf("[INFO]: [%v] Reconnected to %v after %d attempts.\n", cam.ID, cam.SourceName(), attempt)
+			cam.setConnected(true, nil)
+			return
+		}
+		log.Printf("[WARN]: [%v] Reconnect attempt %d failed: %v; retrying in %v.\n", cam.ID, attempt, err, backoff)
+		cam.setConnected(false, err)
+
+		if backoff *= 2; backoff > cam.config.Reconnect.MaxBackoff {
+			backoff = cam.config.Reconnect.MaxBackoff
+		}
+	}
+}
+
+// waitOffline keeps the placeholder on the stream for d. It returns false
+// if ctx was cancelled first.
+func (cam *Camera) waitOffline(ctx context.Context, d time.Duration, placeholder []byte) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(d)
+	for {
+		cam.stream.UpdateJPEG(placeholder)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return true
+		case <-ticker.C:
+		}
+	}
+}
+
+// reopenSource opens the frame source again and reads one frame from it.
+func (cam *Camera) reopenSource() error {
+	source, err := openFrameSource(cam.config.Source)
+	if err != nil {
+		return err
+	}
+	if device, ok := source.(*deviceSource); ok {
+		device.Configure(cam.config.Saturation, cam.config.FPS, cam.config.Brightness, cam.config.Contrast)
+	}
+
+	cam.mut.Lock()
+	defer cam.mut.Unlock()
+	if err := source.Read(&cam.img); err != nil {
+		source.Close()
+		return err
+	}
+	cam.prepareFrame()
+	cam.source = source
+
+	cam.runMut.Lock()
+	cam.sourceName = source.String()
+	cam.runMut.Unlock()
+	return nil
+}
+
+// offlineFrame renders the JPEG shown on /cam while the camera is offline,
+// at the size of the last good frame.
+func (cam *Camera) offlineFrame() []byte {
+	cam.mut.Lock()
+	rows, cols := cam.img.Rows(), cam.img.Cols()
+	cam.mut.Unlock()
+	if rows == 0 || cols == 0 {
+		rows, cols = 480, 640
+	}
+
+	img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(40, 40, 40, 0), rows, cols, gocv.MatTypeCV8UC3)
+	defer img.Close()
+
+	text := cam.Name + ": camera offline"
+	scale := float64(cols) / 640
+	size := gocv.GetTextSize(text, gocv.FontHersheySimplex, scale, 2)
+	origin := image.Pt((cols-size.X)/2, (rows+size.Y)/2)
+	gocv.PutText(&img, text, origin, gocv.FontHersheySimplex, scale, color.RGBA{R: 220, G: 220, B: 220}, 2)
+
+	buf, _ := gocv.IMEncode(".jpg", img)
+	return buf
+}
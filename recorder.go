@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+const eventStoragePrefix string = "EVT_"
+
+// EventConfig controls event-triggered clips.
+type EventConfig struct {
+	// Triggers lists what may start a clip: "motion", "face" and/or "manual".
+	Triggers []string
+	// PreRoll and PostRoll pad event clips before and after the trigger.
+	PreRoll  time.Duration
+	PostRoll time.Duration
+	// BufferMemory caps the pre-roll buffer, e.g. "64MB".
+	BufferMemory string
+	// Cooldown is the minimum gap between two logged events of the same kind.
+	Cooldown time.Duration
+	// Snapshots saves a SNAP_ JPEG next to the clips for every logged event.
+	Snapshots bool
+}
+
+func (cfg EventConfig) triggeredBy(kind string) bool {
+	for _, trigger := range cfg.Triggers {
+		if trigger == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// ClipInfo is written as a JSON sidecar next to every event clip.
+type ClipInfo struct {
+	Camera string
+	Kind   string
+	Clip   string
+	Start  time.Time
+	End    time.Time
+}
+
+// EventRecorder writes a clip only while something is happening. It keeps
+// the last PreRoll of encoded frames in a RingBuffer so the clip starts
+// before the trigger, and keeps recording for PostRoll after the last trigger.
+// Clips are written at a fixed fps whatever the capture rate: frames are
+// repeated or dropped by their capture time so clips play back in real time.
+type EventRecorder struct {
+	camera   string
+	archive  *ArchiveStore
+	fps      float64
+	postRoll time.Duration
+
+	buffer      *RingBuffer
+	writer      *gocv.VideoWriter
+	clip        *ClipInfo
+	lastTrigger time.Time
+	// first is the capture time of the clip's first frame, and written the
+	// number of frames written since
+	first   time.Time
+	written int
+}
+
+func newEventRecorder(camera string, archive *ArchiveStore, fps float64, preRoll, postRoll time.Duration, bufferMemory int64) *EventRecorder {
+	if fps <= 0 {
+		fps = 20
+	}
+	return &EventRecorder{
+		camera:   camera,
+		archive:  archive,
+		fps:      fps,
+		postRoll: postRoll,
+		buffer:   newRingBuffer(preRoll, bufferMemory),
+	}
+}
+
+// Update feeds the recorder the latest frame. kind names the trigger when
+// one fired on this frame and is empty otherwise.
+func (r *EventRecorder) Update(img gocv.Mat, now time.Time, kind string) {
+	if kind != "" {
+		r.lastTrigger = now
+		if r.writer == nil {
+			r.startClip(img, now, kind)
+		}
+	}
+
+	if r.writer == nil {
+		if buf, err := gocv.IMEncode(".jpg", img); err == nil {
+			r.buffer.Push(now, buf)
+		}
+		return
+	}
+
+	r.write(img, now)
+	if now.Sub(r.lastTrigger) > r.postRoll {
+		r.finishClip(r.lastTrigger)
+	}
+}
+
+// Recording reports whether a clip is currently being written.
+func (r *EventRecorder) Recording() bool {
+	return r.writer != nil
+}
+
+// CurrentClip is the file name of the clip being written, if any.
+func (r *EventRecorder) CurrentClip() string {
+	if r.clip == nil {
+		return ""
+	}
+	return r.clip.Clip
+}
+
+func (r *EventRecorder) startClip(img gocv.Mat, now time.Time, kind string) {
+	name := eventStoragePrefix + kind + "_" + now.Format(time.RFC3339) + ".avi"
+	path, err := r.archive.Create(name)
+	if err != nil {
+		log.Printf("[ERROR]: [%v] %v\n", r.camera, err)
+		return
+	}
+
+	writer, err := gocv.VideoWriterFile(path, "MJPG", r.fps, img.Cols(), img.Rows(), true)
+	if err != nil {
+		log.Printf("[ERROR]: [%v] Unable to open video writer %v: %v\n", r.camera, path, err)
+		return
+	}
+	r.writer = writer
+	r.clip = &ClipInfo{Camera: r.camera, Kind: kind, Clip: name, Start: now}
+	log.Printf("[INFO]: [%v] %v event started; recording to %v\n", r.camera, kind, path)
+
+	// Flush the pre-roll so the clip includes the moments before the trigger
+	preRoll := r.buffer.Drain()
+	r.first, r.written = now, 0
+	if len(preRoll) > 0 {
+		r.first = preRoll[0].at
+	}
+	for _, frame := range preRoll {
+		decoded, err := gocv.IMDecode(frame.jpeg, gocv.IMReadColor)
+		if err == nil && decoded.Cols() == img.Cols() && decoded.Rows() == img.Rows() {
+			r.write(decoded, frame.at)
+		}
+		decoded.Close()
+	}
+	if len(preRoll) > 0 {
+		log.Printf("[INFO]: [%v] Flushed %v of pre-roll (%d frames)\n", r.camera, now.Sub(preRoll[0].at), len(preRoll))
+	}
+}
+
+// write adds img, captured at, to the clip as often as the clip's fps
+// calls for: repeated when capture is slower, skipped when it is faster.
+func (r *EventRecorder) write(img gocv.Mat, at time.Time) {
+	for due := framesDue(r.first, at, r.fps); r.written < due; r.written++ {
+		r.writer.Write(img)
+	}
+}
+
+// framesDue is how many frames a clip at fps starting at first should have
+// once the frame captured at is written.
+func framesDue(first, at time.Time, fps float64) int {
+	return int(at.Sub(first).Seconds()*fps) + 1
+}
+
+func (r *EventRecorder) finishClip(end time.Time) {
+	r.writer.Close()
+	r.writer = nil
+	r.clip.End = end
+
+	sidecar, err := r.archive.Create(sidecarOfClip(r.clip.Clip))
+	var js []byte
+	if err == nil {
+		js, err = json.MarshalIndent(r.clip, "", "  ")
+	}
+	if err == nil {
+		err = ioutil.WriteFile(sidecar, js, 0644)
+	}
+	if err != nil {
+		log.Printf("[ERROR]: [%v] Unable to write event details %v: %v\n", r.camera, sidecar, err)
+	}
+	log.Printf("[INFO]: [%v] %v event ended after %v\n", r.camera, r.clip.Kind, end.Sub(r.clip.Start))
+	r.clip = nil
+}
+
+// Close finishes any clip in progress and releases the pre-roll buffer.
+func (r *EventRecorder) Close() {
+	if r.writer != nil {
+		r.finishClip(r.lastTrigger)
+	}
+	r.buffer.Drain()
+}
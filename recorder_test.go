@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFramesDue(t *testing.T) {
+	first := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		after time.Duration
+		fps   float64
+		want  int
+	}{
+		{"first frame", 0, 20, 1},
+		{"within the first frame", 49 * time.Millisecond, 20, 1},
+		{"second frame", 50 * time.Millisecond, 20, 2},
+		{"one second", time.Second, 20, 21},
+		{"slow fps", 2500 * time.Millisecond, 2, 6},
+	}
+	for _, tt := range tests {
+		if got := framesDue(first, first.Add(tt.after), tt.fps); got != tt.want {
+			t.Errorf("%v: framesDue() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFramesDueCadence(t *testing.T) {
+	// Capture at 5 fps and at 50 fps: either way a 20 fps clip of two
+	// seconds gets 41 frames, repeating or dropping captured ones
+	first := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, interval := range []time.Duration{200 * time.Millisecond, 20 * time.Millisecond} {
+		written := 0
+		for at := first; !at.After(first.Add(2 * time.Second)); at = at.Add(interval) {
+			if due := framesDue(first, at, 20); due > written {
+				written = due
+			}
+		}
+		if written != 41 {
+			t.Errorf("capturing every %v: %d frames written, want 41", interval, written)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RetentionRule limits how much of one kind of recording is kept.
+// Zero values mean no limit.
+type RetentionRule struct {
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+// RetentionConfig is the retention: section. Rules apply to the archives of
+// all cameras together, since they usually share one disk.
+type RetentionConfig struct {
+	Interval time.Duration
+	// MinFreeDisk deletes the oldest recordings of any kind until the disk
+	// holding the archive has at least this much free.
+	MinFreeDisk int64
+	Rules       map[string]RetentionRule
+}
+
+// retentionKinds maps archive prefixes to the retention rule that covers them.
+var retentionKinds = map[string]string{
+	tempStoragePrefix:  "continuous",
+	eventStoragePrefix: "events",
+	snapshotPrefix:     "snapshots",
+}
+
+func retentionKind(name string) string {
+	for prefix, kind := range retentionKinds {
+		if strings.HasPrefix(name, prefix) {
+			return kind
+		}
+	}
+	return ""
+}
+
+func loadRetentionConfig() (RetentionConfig, error) {
+	cfg := RetentionConfig{
+		Interval: viper.GetDuration("retention.interval"),
+		Rules:    map[string]RetentionRule{},
+	}
+	if cfg.Interval <= 0 {
+		return cfg, fmt.Errorf("retention.interval must be positive")
+	}
+	minFree, err := parseByteSize(viper.GetString("retention.minFreeDisk"))
+	if err != nil {
+		return cfg, fmt.Errorf("retention.minFreeDisk: %v", err)
+	}
+	cfg.MinFreeDisk = minFree
+
+	for _, kind := range retentionKinds {
+		key := "retention." + kind
+		rule := RetentionRule{MaxAge: viper.GetDuration(key + ".maxAge")}
+		if size := viper.GetString(key + ".maxSize"); size != "" {
+			if rule.MaxSize, err = parseByteSize(size); err != nil {
+				return cfg, fmt.Errorf("%v.maxSize: %v", key, err)
+			}
+		}
+		cfg.Rules[kind] = rule
+	}
+
+	// tempKeepTime predates the retention section; the rules have no viper
+	// defaults, so IsSet only reports keys from the config file
+	if keep := viper.GetDuration("tempKeepTime"); keep > 0 && !viper.IsSet("retention.continuous.maxAge") {
+		log.Println("[WARN]: tempKeepTime is deprecated; use retention.continuous.maxAge instead.")
+		rule := cfg.Rules["continuous"]
+		rule.MaxAge = keep
+		cfg.Rules["continuous"] = rule
+	}
+	return cfg, nil
+}
+
+// retainedFile is a recording retention deletes as one, with any files
+// that belong to it: an event clip goes with its ClipInfo sidecar.
+type retainedFile struct {
+	cam      *Camera
+	info     os.FileInfo
+	kind     string
+	sidecars []os.FileInfo
+	// size counts the sidecars too
+	size int64
+}
+
+func (f retainedFile) String() string {
+	return filepath.Join(f.cam.archive.dir, f.info.Name())
+}
+
+// runRetention enforces the retention rules every cfg.Interval until ctx
+// is cancelled.
+func runRetention(ctx context.Context, cfg RetentionConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		enforceRetention(cfg, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforceRetention deletes recordings, oldest first, that are past their
+// kind's maximum age, that push their kind over its maximum size, or while
+// the disk is below the free space watermark. Event clips and their
+// sidecars are aged, counted and deleted together. Recordings still being
+// written are never deleted.
+func enforceRetention(cfg RetentionConfig, now time.Time) {
+	files := []retainedFile{}
+	for _, cam := range cameras {
+		infos, err := cam.archive.List()
+		if err != nil {
+			log.Printf("[ERROR]: [%v] Retention unable to list archive: %v\n", cam.ID, err)
+			continue
+		}
+		active := cam.activeRecordings()
+		byName := map[string]os.FileInfo{}
+		for _, info := range infos {
+			byName[info.Name()] = info
+		}
+		for _, info := range infos {
+			kind := retentionKind(info.Name())
+			if kind == "" || active[info.Name()] {
+				continue
+			}
+			if _, ok := byName[clipOfSidecar(info.Name())]; ok {
+				continue
+			}
+			f := retainedFile{cam: cam, info: info, kind: kind, size: info.Size()}
+			if sidecar, ok := byName[sidecarOfClip(info.Name())]; ok {
+				f.sidecars = append(f.sidecars, sidecar)
+				f.size += sidecar.Size()
+			}
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+
+	removed := 0
+	var freed int64
+	remove := func(f retainedFile, reason string) bool {
+		if err := f.cam.archive.Delete(f.info.Name()); err != nil && err != ErrArchiveNotFound {
+			log.Printf("[ERROR]: Retention unable to delete %v: %v\n", f, err)
+			return false
+		}
+		for _, sidecar := range f.sidecars {
+			if err := f.cam.archive.Delete(sidecar.Name()); err != nil && err != ErrArchiveNotFound {
+				log.Printf("[ERROR]: Retention unable to delete %v: %v\n", sidecar.Name(), err)
+			}
+		}
+		log.Printf("[INFO]: Retention deleted %v (%v, %d bytes): %v\n", f, f.kind, f.size, reason)
+		removed++
+		freed += f.size
+		return true
+	}
+
+	// Maximum age, then maximum total size per kind
+	kept := []retainedFile{}
+	sizes := map[string]int64{}
+	for _, f := range files {
+		rule := cfg.Rules[f.kind]
+		if rule.MaxAge > 0 && now.Sub(f.info.ModTime()) > rule.MaxAge && remove(f, "older than "+rule.MaxAge.String()) {
+			continue
+		}
+		kept = append(kept, f)
+		sizes[f.kind] += f.size
+	}
+	files, kept = kept, []retainedFile{}
+	for _, f := range files {
+		rule := cfg.Rules[f.kind]
+		if rule.MaxSize > 0 && sizes[f.kind] > rule.MaxSize && remove(f, fmt.Sprintf("%v over %d bytes", f.kind, rule.MaxSize)) {
+			sizes[f.kind] -= f.size
+			continue
+		}
+		kept = append(kept, f)
+	}
+
+	// Free disk watermark, across every kind
+	if cfg.MinFreeDisk > 0 {
+		free, _, err := diskSpace(archiveRoot)
+		if err != nil {
+			log.Printf("[ERROR]: Retention unable to check free disk space: %v\n", err)
+		} else {
+			for _, f := range kept {
+				if int64(free) >= cfg.MinFreeDisk {
+					break
+				}
+				if remove(f, fmt.Sprintf("less than %d bytes free", cfg.MinFreeDisk)) {
+					free += uint64(f.size)
+				}
+			}
+			if int64(free) < cfg.MinFreeDisk {
+				log.Printf("[WARN]: Only %d bytes free in %v after retention; nothing left to delete.\n", free, archiveRoot)
+			}
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("[INFO]: Retention deleted %d recordings, freeing %d bytes.\n", removed, freed)
+	}
+}
+
+// sidecarOfClip is the ClipInfo sidecar written next to an event clip, or
+// empty for other names.
+func sidecarOfClip(name string) string {
+	if !strings.HasPrefix(name, eventStoragePrefix) || !strings.HasSuffix(name, ".avi") {
+		return ""
+	}
+	return strings.TrimSuffix(name, ".avi") + ".json"
+}
+
+// clipOfSidecar is the event clip a ClipInfo sidecar describes, or empty
+// for other names.
+func clipOfSidecar(name string) string {
+	if !strings.HasPrefix(name, eventStoragePrefix) || !strings.HasSuffix(name, ".json") {
+		return ""
+	}
+	return strings.TrimSuffix(name, ".json") + ".avi"
+}
+
+// activeRecordings names the files the camera is writing right now.
+func (cam *Camera) activeRecordings() map[string]bool {
+	active := map[string]bool{}
+	if name := cam.ContinuousFile(); name != "" {
+		active[name] = true
+	}
+	cam.mut.Lock()
+	if clip := cam.recorder.CurrentClip(); clip != "" {
+		active[clip] = true
+	}
+	cam.mut.Unlock()
+	return active
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestEnforceRetention(t *testing.T) {
+	type file struct {
+		camera, name string
+		age          time.Duration
+		size         int
+	}
+	// TMP_3.avi and EVT_person_4.avi are being written. Event details are
+	// written a minute after their clip; EVT_person_2.avi was deleted by hand.
+	files := []file{
+		{"front", "TMP_1.avi", 3 * time.Hour, 100},
+		{"front", "TMP_2.avi", 2 * time.Hour, 100},
+		{"front", "TMP_3.avi", 4 * time.Hour, 100},
+		{"front", "EVT_motion_1.avi", 5 * time.Hour, 100},
+		{"front", "EVT_motion_1.json", 5*time.Hour - time.Minute, 20},
+		{"front", "EVT_motion_2.avi", time.Hour, 100},
+		{"front", "EVT_motion_2.json", time.Hour - time.Minute, 20},
+		{"front", "SNAP_manual_1.jpg", 6 * time.Hour, 10},
+		{"back", "TMP_4.avi", 30 * time.Minute, 100},
+		{"back", "EVT_person_2.json", 8 * time.Hour, 20},
+		{"back", "EVT_person_3.avi", 3 * time.Hour, 100},
+		{"back", "EVT_person_3.json", 3*time.Hour - time.Minute, 20},
+		{"back", "EVT_person_4.avi", 4 * time.Hour, 100},
+	}
+	all := []string{}
+	for _, f := range files {
+		all = append(all, f.camera+"/"+f.name)
+	}
+	except := func(deleted ...string) []string {
+		kept := []string{}
+		for _, name := range all {
+			if !contains(deleted, name) {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+
+	tests := []struct {
+		name        string
+		rules       map[string]RetentionRule
+		minFreeDisk int64
+		want        []string
+	}{
+		{"no rules", nil, 0, all},
+		{"continuous by age", map[string]RetentionRule{"continuous": {MaxAge: 150 * time.Minute}}, 0,
+			except("front/TMP_1.avi")},
+		{"events by size across cameras", map[string]RetentionRule{"events": {MaxSize: 250}}, 0,
+			except("back/EVT_person_2.json", "front/EVT_motion_1.avi", "front/EVT_motion_1.json")},
+		{"event details count with their clip", map[string]RetentionRule{"events": {MaxSize: 230}}, 0,
+			except("back/EVT_person_2.json", "front/EVT_motion_1.avi", "front/EVT_motion_1.json",
+				"back/EVT_person_3.avi", "back/EVT_person_3.json")},
+		{"event details age with their clip", map[string]RetentionRule{"events": {MaxAge: 5*time.Hour - 30*time.Second}}, 0,
+			except("back/EVT_person_2.json", "front/EVT_motion_1.avi", "front/EVT_motion_1.json")},
+		{"age before size", map[string]RetentionRule{"continuous": {MaxAge: 150 * time.Minute, MaxSize: 100}}, 0,
+			except("front/TMP_1.avi", "front/TMP_2.avi")},
+		{"rules are per kind", map[string]RetentionRule{"snapshots": {MaxAge: time.Hour}, "events": {MaxAge: 24 * time.Hour}}, 0,
+			except("front/SNAP_manual_1.jpg")},
+		{"free disk deletes everything it can", nil, 1 << 62,
+			[]string{"front/TMP_3.avi", "back/EVT_person_4.avi"}},
+		{"enough free disk", nil, 1, all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			front, back := newTestCamera(t, "front"), newTestCamera(t, "back")
+			useCameras(t, front, back)
+			front.setContinuousFile("TMP_3.avi")
+			back.recorder.clip = &ClipInfo{Clip: "EVT_person_4.avi"}
+
+			now := time.Now()
+			for _, f := range files {
+				path, err := camerasByID[f.camera].archive.Create(f.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, now.Add(-f.age), now.Add(-f.age)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			enforceRetention(RetentionConfig{MinFreeDisk: tt.minFreeDisk, Rules: tt.rules}, now)
+
+			got := []string{}
+			for _, cam := range cameras {
+				infos, err := cam.archive.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, info := range infos {
+					got = append(got, cam.ID+"/"+info.Name())
+				}
+			}
+			sort.Strings(got)
+			want := append([]string{}, tt.want...)
+			sort.Strings(want)
+			if !equalStrings(got, want) {
+				t.Errorf("kept %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
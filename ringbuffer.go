@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+)
+
+type bufferedFrame struct {
+	at   time.Time
+	jpeg []byte
+}
+
+// RingBuffer holds the most recent window of JPEG-encoded frames, bounded
+// both by age and by total encoded size, so a clip can start with the
+// moments before its trigger.
+type RingBuffer struct {
+	window   time.Duration
+	maxBytes int64
+
+	frames []bufferedFrame
+	head   int
+	count  int
+	size   int64
+}
+
+func newRingBuffer(window time.Duration, maxBytes int64) *RingBuffer {
+	return &RingBuffer{window: window, maxBytes: maxBytes}
+}
+
+// Push adds a frame, evicting the oldest ones that fall outside the window
+// or push the buffer over its memory cap.
+func (b *RingBuffer) Push(at time.Time, jpeg []byte) {
+	if b.window <= 0 || int64(len(jpeg)) > b.maxBytes {
+		return
+	}
+
+	// Grow the ring when it is full rather than dropping frames still in the window
+	if b.count == len(b.frames) {
+		grown := make([]bufferedFrame, 2*len(b.frames)+16)
+		for i := 0; i < b.count; i++ {
+			grown[i] = b.frames[(b.head+i)%len(b.frames)]
+		}
+		b.frames = grown
+		b.head = 0
+	}
+	b.frames[(b.head+b.count)%len(b.frames)] = bufferedFrame{at, jpeg}
+	b.count++
+	b.size += int64(len(jpeg))
+
+	for b.count > 0 {
+		oldest := b.frames[b.head]
+		if at.Sub(oldest.at) <= b.window && b.size <= b.maxBytes {
+			break
+		}
+		b.evict()
+	}
+}
+
+func (b *RingBuffer) evict() {
+	b.size -= int64(len(b.frames[b.head].jpeg))
+	b.frames[b.head] = bufferedFrame{}
+	b.head = (b.head + 1) % len(b.frames)
+	b.count--
+}
+
+// Drain returns the buffered frames oldest first and empties the buffer.
+func (b *RingBuffer) Drain() []bufferedFrame {
+	frames := make([]bufferedFrame, 0, b.count)
+	for b.count > 0 {
+		frames = append(frames, b.frames[b.head])
+		b.evict()
+	}
+	return frames
+}
+
+// Size is the total encoded size of the buffered frames in bytes.
+func (b *RingBuffer) Size() int64 {
+	return b.size
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRingBuffer(t *testing.T) {
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	frame := func(size int) []byte { return bytes.Repeat([]byte{0xff}, size) }
+
+	tests := []struct {
+		name     string
+		window   time.Duration
+		maxBytes int64
+		// frames are pushed one every 100ms with these sizes
+		sizes []int
+		// want are the indexes of the frames left, oldest first
+		want []int
+	}{
+		{"keeps everything in the window", time.Second, 1000, []int{10, 10, 10}, []int{0, 1, 2}},
+		{"evicts by age", 250 * time.Millisecond, 1000, []int{10, 10, 10, 10, 10}, []int{2, 3, 4}},
+		{"evicts by size", time.Minute, 25, []int{10, 10, 10, 10}, []int{2, 3}},
+		{"drops frames larger than the cap", time.Minute, 25, []int{10, 30, 10}, []int{0, 2}},
+		{"disabled without a window", 0, 1000, []int{10, 10}, []int{}},
+		{"grows past its initial capacity", time.Minute, 1 << 20, make([]int, 40), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRingBuffer(tt.window, tt.maxBytes)
+			for i, size := range tt.sizes {
+				// The first byte identifies the frame
+				b.Push(start.Add(time.Duration(i)*100*time.Millisecond), append([]byte{byte(i)}, frame(size)...))
+			}
+
+			want := tt.want
+			if want == nil {
+				want = make([]int, len(tt.sizes))
+				for i := range want {
+					want[i] = i
+				}
+			}
+			var size int64
+			for _, i := range want {
+				size += int64(tt.sizes[i] + 1)
+			}
+			if b.Size() != size {
+				t.Errorf("Size() = %d, want %d", b.Size(), size)
+			}
+
+			frames := b.Drain()
+			if len(frames) != len(want) {
+				t.Fatalf("drained %d frames, want %d", len(frames), len(want))
+			}
+			for j, f := range frames {
+				if int(f.jpeg[0]) != want[j] {
+					t.Errorf("frames[%d] is frame %d, want %d", j, f.jpeg[0], want[j])
+				}
+				if !f.at.Equal(start.Add(time.Duration(want[j]) * 100 * time.Millisecond)) {
+					t.Errorf("frames[%d] has time %v", j, f.at)
+				}
+			}
+			if b.Size() != 0 || len(b.Drain()) != 0 {
+				t.Errorf("buffer not empty after Drain")
+			}
+		})
+	}
+}
+
+func TestRingBufferReuseAfterDrain(t *testing.T) {
+	start := time.Now()
+	b := newRingBuffer(time.Second, 100)
+	for i := 0; i < 3; i++ {
+		b.Push(start, []byte{byte(i)})
+	}
+	b.Drain()
+
+	b.Push(start.Add(time.Second), []byte{7, 7})
+	frames := b.Drain()
+	if len(frames) != 1 || !bytes.Equal(frames[0].jpeg, []byte{7, 7}) {
+		t.Errorf("Drain() after reuse = %v, want the one new frame", frames)
+	}
+}
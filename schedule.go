@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Activities a schedule can switch on and off.
+const (
+	activityRecording     = "recording"
+	activityDetection     = "detection"
+	activityNotifications = "notifications"
+)
+
+var scheduleActivities = []string{activityRecording, activityDetection, activityNotifications}
+
+// ScheduleRule makes a schedule active on the given days between From and
+// To ("HH:MM"). A range that ends before it starts runs past midnight into
+// the next day; leaving both out covers the whole day.
+type ScheduleRule struct {
+	// Days are mon..sun, or weekdays, weekends or daily.
+	Days []string
+	From string
+	To   string
+}
+
+// ScheduleException overrides a schedule for a whole date ("2006-01-02").
+type ScheduleException struct {
+	Date   string
+	Active bool
+}
+
+// ScheduleConfig is one entry of the schedules: list. While any schedule
+// covering an activity is active the activity runs; activities no schedule
+// covers always run.
+type ScheduleConfig struct {
+	Name string
+	// Activities are recording (continuous TMP_ clips), detection and notifications.
+	Activities []string
+	// Cameras the schedule applies to; empty means all.
+	Cameras    []string
+	Rules      []ScheduleRule
+	Exceptions []ScheduleException
+}
+
+type scheduleRange struct {
+	days     [7]bool // indexed by time.Weekday
+	from, to int     // minutes since midnight
+}
+
+type schedule struct {
+	config     ScheduleConfig
+	ranges     []scheduleRange
+	exceptions map[string]bool
+}
+
+// Scheduler decides which activities run at a given time.
+type Scheduler struct {
+	location  *time.Location
+	schedules []*schedule
+}
+
+var scheduler = &Scheduler{location: time.Local}
+
+var weekdays = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+	"daily":    {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+func loadScheduler(cameraIDs []string) (*Scheduler, error) {
+	s := &Scheduler{location: time.Local}
+	if tz := viper.GetString("scheduleTimeZone"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("scheduleTimeZone: %v", err)
+		}
+		s.location = location
+	}
+
+	configs := []ScheduleConfig{}
+	if err := viper.UnmarshalKey("schedules", &configs); err != nil {
+		return nil, err
+	}
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("schedule%d", i)
+		}
+		sched, err := newSchedule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("schedules[%d]: %v", i, err)
+		}
+		for _, id := range cfg.Cameras {
+			if !contains(cameraIDs, id) {
+				return nil, fmt.Errorf("schedules[%d]: unknown camera %q", i, id)
+			}
+		}
+		s.schedules = append(s.schedules, sched)
+	}
+	return s, nil
+}
+
+func newSchedule(cfg ScheduleConfig) (*schedule, error) {
+	if len(cfg.Activities) == 0 {
+		return nil, fmt.Errorf("no activities")
+	}
+	for _, activity := range cfg.Activities {
+		if !contains(scheduleActivities, activity) {
+			return nil, fmt.Errorf("unknown activity %q (expected %v)", activity, strings.Join(scheduleActivities, ", "))
+		}
+	}
+
+	sched := &schedule{config: cfg, exceptions: map[string]bool{}}
+	for j, rule := range cfg.Rules {
+		r := scheduleRange{to: 24 * 60}
+		if len(rule.Days) == 0 {
+			rule.Days = []string{"daily"}
+		}
+		for _, day := range rule.Days {
+			days, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("rules[%d]: unknown day %q", j, day)
+			}
+			for _, d := range days {
+				r.days[d] = true
+			}
+		}
+		var err error
+		if rule.From != "" {
+			if r.from, err = parseClock(rule.From); err != nil {
+				return nil, fmt.Errorf("rules[%d].from: %v", j, err)
+			}
+		}
+		if rule.To != "" {
+			if r.to, err = parseClock(rule.To); err != nil {
+				return nil, fmt.Errorf("rules[%d].to: %v", j, err)
+			}
+		}
+		sched.ranges = append(sched.ranges, r)
+	}
+	for j, exception := range cfg.Exceptions {
+		if _, err := time.Parse("2006-01-02", exception.Date); err != nil {
+			return nil, fmt.Errorf("exceptions[%d]: invalid date %q", j, exception.Date)
+		}
+		sched.exceptions[exception.Date] = exception.Active
+	}
+	return sched, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight; "24:00" is allowed.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// activeAt reports whether the schedule is on at t, which must already be
+// in the scheduler's time zone.
+func (s *schedule) activeAt(t time.Time) bool {
+	if active, ok := s.exceptions[t.Format("2006-01-02")]; ok {
+		return active
+	}
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, r := range s.ranges {
+		if r.from < r.to {
+			if r.days[today] && minute >= r.from && minute < r.to {
+				return true
+			}
+			continue
+		}
+		// Runs past midnight: the evening of a listed day or the morning after one
+		if r.days[today] && minute >= r.from || r.days[yesterday] && minute < r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *schedule) covers(camera, activity string) bool {
+	return contains(s.config.Activities, activity) && (len(s.config.Cameras) == 0 || contains(s.config.Cameras, camera))
+}
+
+// Active reports whether the activity should run on the camera at t.
+func (s *Scheduler) Active(camera, activity string, t time.Time) bool {
+	t = t.In(s.location)
+	covered := false
+	for _, sched := range s.schedules {
+		if sched.covers(camera, activity) {
+			if sched.activeAt(t) {
+				return true
+			}
+			covered = true
+		}
+	}
+	return !covered
+}
+
+// nextChange finds the next minute after from at which active changes
+// value, looking up to 8 days ahead.
+func (s *Scheduler) nextChange(from time.Time, active func(time.Time) bool) *time.Time {
+	from = from.In(s.location)
+	now := active(from)
+	t := from.Truncate(time.Minute)
+	for end := from.Add(8 * 24 * time.Hour); t.Before(end); {
+		t = t.Add(time.Minute)
+		if active(t) != now {
+			return &t
+		}
+	}
+	return nil
+}
+
+// ScheduleState is whether something is active now and when that changes.
+type ScheduleState struct {
+	Active     bool
+	NextChange *time.Time `json:",omitempty"`
+}
+
+type ScheduleInfo struct {
+	ScheduleConfig
+	ScheduleState
+}
+
+type CameraSchedule struct {
+	ID         string
+	Activities map[string]ScheduleState
+}
+
+type ScheduleResponse struct {
+	TimeZone  string
+	Now       time.Time
+	Schedules []ScheduleInfo
+	Cameras   []CameraSchedule
+}
+
+// ScheduleHandler serves GET /api/schedule: every schedule and, for each
+// camera, whether recording, detection and notifications are active now
+// and when that next changes.
+func ScheduleHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	now := time.Now().In(scheduler.location)
+	resp := ScheduleResponse{TimeZone: scheduler.location.String(), Now: now, Schedules: []ScheduleInfo{}, Cameras: []CameraSchedule{}}
+
+	for _, sched := range scheduler.schedules {
+		sched := sched
+		resp.Schedules = append(resp.Schedules, ScheduleInfo{sched.config, ScheduleState{
+			Active:     sched.activeAt(now),
+			NextChange: scheduler.nextChange(now, func(t time.Time) bool { return sched.activeAt(t) }),
+		}})
+	}
+
+	for _, cam := range cameras {
+		cs := CameraSchedule{ID: cam.ID, Activities: map[string]ScheduleState{}}
+		for _, activity := range scheduleActivities {
+			id, activity := cam.ID, activity
+			active := func(t time.Time) bool { return scheduler.Active(id, activity, t) }
+			cs.Activities[activity] = ScheduleState{active(now), scheduler.nextChange(now, active)}
+		}
+		resp.Cameras = append(resp.Cameras, cs)
+	}
+	writeJSON(w, resp)
+}
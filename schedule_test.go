@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActiveAt(t *testing.T) {
+	// 2018-10-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		minutes, err := parseClock(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2018, 10, day, 0, minutes, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		rules []ScheduleRule
+		// exceptions override whole dates
+		exceptions []ScheduleException
+		t          time.Time
+		want       bool
+	}{
+		{"daytime range", []ScheduleRule{{Days: []string{"weekdays"}, From: "09:00", To: "17:00"}}, nil, at(1, "12:00"), true},
+		{"before a daytime range", []ScheduleRule{{Days: []string{"weekdays"}, From: "09:00", To: "17:00"}}, nil, at(1, "08:59"), false},
+		{"end is exclusive", []ScheduleRule{{Days: []string{"weekdays"}, From: "09:00", To: "17:00"}}, nil, at(1, "17:00"), false},
+		{"day not listed", []ScheduleRule{{Days: []string{"weekdays"}, From: "09:00", To: "17:00"}}, nil, at(6, "12:00"), false},
+		{"whole day", []ScheduleRule{{Days: []string{"sat"}}}, nil, at(6, "23:59"), true},
+		{"no days means daily", []ScheduleRule{{From: "00:00", To: "24:00"}}, nil, at(3, "00:00"), true},
+
+		// 22:00-06:00 on Friday covers Friday night and Saturday morning
+		{"overnight evening", []ScheduleRule{{Days: []string{"fri"}, From: "22:00", To: "06:00"}}, nil, at(5, "23:30"), true},
+		{"overnight next morning", []ScheduleRule{{Days: []string{"fri"}, From: "22:00", To: "06:00"}}, nil, at(6, "05:59"), true},
+		{"overnight ended", []ScheduleRule{{Days: []string{"fri"}, From: "22:00", To: "06:00"}}, nil, at(6, "06:00"), false},
+		{"overnight morning of the listed day", []ScheduleRule{{Days: []string{"fri"}, From: "22:00", To: "06:00"}}, nil, at(5, "03:00"), false},
+		{"overnight from sunday into monday", []ScheduleRule{{Days: []string{"sun"}, From: "20:00", To: "02:00"}}, nil, at(1, "01:00"), true},
+
+		{"exception turns off", []ScheduleRule{{Days: []string{"daily"}}}, []ScheduleException{{Date: "2018-10-03", Active: false}}, at(3, "12:00"), false},
+		{"exception turns on", []ScheduleRule{{Days: []string{"weekends"}}}, []ScheduleException{{Date: "2018-10-03", Active: true}}, at(3, "12:00"), true},
+		{"exception only that date", []ScheduleRule{{Days: []string{"daily"}}}, []ScheduleException{{Date: "2018-10-03", Active: false}}, at(4, "00:00"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, err := newSchedule(ScheduleConfig{Activities: []string{activityRecording}, Rules: tt.rules, Exceptions: tt.exceptions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sched.activeAt(tt.t); got != tt.want {
+				t.Errorf("activeAt(%v) = %v, want %v", tt.t.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerActive(t *testing.T) {
+	night, err := newSchedule(ScheduleConfig{
+		Activities: []string{activityNotifications},
+		Cameras:    []string{"front"},
+		Rules:      []ScheduleRule{{From: "22:00", To: "06:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Scheduler{location: time.UTC, schedules: []*schedule{night}}
+	noon := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	midnight := time.Date(2018, 10, 1, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		camera, activity string
+		t                time.Time
+		want             bool
+	}{
+		{"front", activityNotifications, midnight, true},
+		{"front", activityNotifications, noon, false},
+		// Activities and cameras no schedule covers always run
+		{"front", activityRecording, noon, true},
+		{"back", activityNotifications, noon, true},
+	}
+	for _, tt := range tests {
+		if got := s.Active(tt.camera, tt.activity, tt.t); got != tt.want {
+			t.Errorf("Active(%v, %v, %v) = %v, want %v", tt.camera, tt.activity, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+
+	next := s.nextChange(noon, func(t time.Time) bool { return s.Active("front", activityNotifications, t) })
+	if want := time.Date(2018, 10, 1, 22, 0, 0, 0, time.UTC); next == nil || !next.Equal(want) {
+		t.Errorf("nextChange = %v, want %v", next, want)
+	}
+}
+
+func TestNewScheduleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ScheduleConfig
+	}{
+		{"no activities", ScheduleConfig{}},
+		{"unknown activity", ScheduleConfig{Activities: []string{"streaming"}}},
+		{"unknown day", ScheduleConfig{Activities: []string{activityDetection}, Rules: []ScheduleRule{{Days: []string{"someday"}}}}},
+		{"invalid time", ScheduleConfig{Activities: []string{activityDetection}, Rules: []ScheduleRule{{From: "25:00"}}}},
+		{"invalid date", ScheduleConfig{Activities: []string{activityDetection}, Exceptions: []ScheduleException{{Date: "01/10/2018"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := newSchedule(tt.cfg); err == nil {
+			t.Errorf("%v: newSchedule() succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// maxSnapshotSize bounds the width and height a snapshot can be scaled to.
+const maxSnapshotSize = 4096
+
+var errCameraUnavailable = errors.New("camera is powered off or offline")
+
+// SnapshotOptions are the query parameters of /api/snapshot.
+type SnapshotOptions struct {
+	// Format is "jpeg" or "png".
+	Format string
+	// Width and Height scale the image; with only one set the aspect ratio is kept.
+	Width   int
+	Height  int
+	Quality int
+	// Overlays includes detection boxes drawn on the frame.
+	Overlays bool
+}
+
+func parseSnapshotOptions(query url.Values) (SnapshotOptions, error) {
+	opts := SnapshotOptions{Format: "jpeg", Quality: 90, Overlays: true}
+
+	switch f := query.Get("format"); f {
+	case "", "jpeg", "jpg":
+	case "png":
+		opts.Format = "png"
+	default:
+		return opts, fmt.Errorf("invalid format %q: must be jpeg or png", f)
+	}
+
+	ints := []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{
+		{"width", &opts.Width, 1, maxSnapshotSize},
+		{"height", &opts.Height, 1, maxSnapshotSize},
+		{"quality", &opts.Quality, 1, 100},
+	}
+	for _, p := range ints {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < p.min || n > p.max {
+			return opts, fmt.Errorf("invalid %v: must be between %d and %d", p.name, p.min, p.max)
+		}
+		*p.dst = n
+	}
+
+	if v := query.Get("overlays"); v != "" {
+		overlays, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid overlays: must be true or false")
+		}
+		opts.Overlays = overlays
+	}
+	return opts, nil
+}
+
+func (opts SnapshotOptions) contentType() string {
+	return "image/" + opts.Format
+}
+
+func (opts SnapshotOptions) extension() string {
+	if opts.Format == "png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+// Snapshot encodes the latest frame according to opts.
+func (cam *Camera) Snapshot(opts SnapshotOptions) ([]byte, error) {
+	if !cam.IsRunning() || !cam.Connection().Connected {
+		return nil, errCameraUnavailable
+	}
+
+	cam.mut.Lock()
+	if cam.closed {
+		cam.mut.Unlock()
+		return nil, errCameraUnavailable
+	}
+	var frame gocv.Mat
+	if opts.Overlays {
+		frame = cam.img.Clone()
+	} else {
+		frame = cam.raw.Clone()
+	}
+	cam.mut.Unlock()
+	defer frame.Close()
+	if frame.Empty() {
+		return nil, errCameraUnavailable
+	}
+
+	// frame is closed by its own defer, so the resized copy gets its own Mat
+	out := frame
+	if size := scaledSize(frame.Cols(), frame.Rows(), opts.Width, opts.Height); size != image.Pt(frame.Cols(), frame.Rows()) {
+		resized := gocv.NewMat()
+		defer resized.Close()
+		gocv.Resize(frame, &resized, size, 0, 0, gocv.InterpolationArea)
+		out = resized
+	}
+
+	img, err := out.ToImage()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if opts.Format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.Quality})
+	}
+	return buf.Bytes(), err
+}
+
+// scaledSize applies the requested width and height to a cols x rows frame,
+// keeping the aspect ratio when only one of them is given.
+func scaledSize(cols, rows, width, height int) image.Point {
+	switch {
+	case width > 0 && height > 0:
+		return image.Pt(width, height)
+	case width > 0:
+		return image.Pt(width, maxInt(1, rows*width/cols))
+	case height > 0:
+		return image.Pt(maxInt(1, cols*height/rows), height)
+	default:
+		return image.Pt(cols, rows)
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// SnapshotResponse describes a snapshot saved with POST /api/snapshot.
+type SnapshotResponse struct {
+	Name string
+	URL  string
+}
+
+// SnapshotHandler serves the primary camera's /api/snapshot.
+func SnapshotHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	if request.Method == http.MethodPost && !authenticator.authorize(w, request, RoleAdmin) {
+		return
+	}
+	snapshotHandler(w, request, primaryCamera())
+}
+
+// snapshotHandler returns the latest frame as an image on GET, and saves it
+// into the archive as SNAP_<label>_<time> on POST:
+//
+//	GET  /api/snapshot?format=png&width=640&quality=80&overlays=false
+//	POST /api/snapshot?label=doorbell
+func snapshotHandler(w http.ResponseWriter, request *http.Request, cam *Camera) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(w, "use GET or POST for snapshots", http.StatusMethodNotAllowed)
+		return
+	}
+	query := request.URL.Query()
+	opts, err := parseSnapshotOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	label := "manual"
+	if v := query.Get("label"); v != "" {
+		if !validCameraID(v) {
+			http.Error(w, "invalid label: use letters, digits, - and _", http.StatusBadRequest)
+			return
+		}
+		label = v
+	}
+
+	img, err := cam.Snapshot(opts)
+	if err == errCameraUnavailable {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR]: [%v] Unable to encode snapshot: %v\n", cam.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		w.Header().Set("Content-Type", opts.contentType())
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(img)
+		return
+	}
+
+	name := snapshotPrefix + label + "_" + time.Now().Format(archiveTimeLayout) + opts.extension()
+	path, err := cam.archive.Create(name)
+	if err == nil {
+		err = ioutil.WriteFile(path, img, 0644)
+	}
+	if err != nil {
+		log.Printf("[ERROR]: [%v] Unable to save snapshot %v: %v\n", cam.ID, name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[INFO]: [%v] Saved snapshot %v\n", cam.ID, name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, SnapshotResponse{name, "/archives/" + url.PathEscape(cam.ID) + "/" + url.PathEscape(name)})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"net/url"
+	"testing"
+)
+
+func TestParseSnapshotOptions(t *testing.T) {
+	defaults := SnapshotOptions{Format: "jpeg", Quality: 90, Overlays: true}
+	tests := []struct {
+		query string
+		want  SnapshotOptions
+		// wantErr means the query is rejected
+		wantErr bool
+	}{
+		{"", defaults, false},
+		{"format=jpg", defaults, false},
+		{"format=png", SnapshotOptions{Format: "png", Quality: 90, Overlays: true}, false},
+		{"width=640", SnapshotOptions{Format: "jpeg", Width: 640, Quality: 90, Overlays: true}, false},
+		{"width=320&height=240&quality=50&overlays=false", SnapshotOptions{Format: "jpeg", Width: 320, Height: 240, Quality: 50}, false},
+		{"width=4096&height=1", SnapshotOptions{Format: "jpeg", Width: 4096, Height: 1, Quality: 90, Overlays: true}, false},
+		{"format=gif", SnapshotOptions{}, true},
+		{"width=0", SnapshotOptions{}, true},
+		{"width=4097", SnapshotOptions{}, true},
+		{"height=-1", SnapshotOptions{}, true},
+		{"width=wide", SnapshotOptions{}, true},
+		{"quality=0", SnapshotOptions{}, true},
+		{"quality=101", SnapshotOptions{}, true},
+		{"overlays=maybe", SnapshotOptions{}, true},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseSnapshotOptions(query)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSnapshotOptions(%q) succeeded, want an error", tt.query)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSnapshotOptions(%q) = %+v, %v, want %+v", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestScaledSize(t *testing.T) {
+	tests := []struct {
+		cols, rows, width, height int
+		want                      image.Point
+	}{
+		{640, 480, 0, 0, image.Pt(640, 480)},
+		{640, 480, 320, 0, image.Pt(320, 240)},
+		{640, 480, 0, 120, image.Pt(160, 120)},
+		{640, 480, 100, 100, image.Pt(100, 100)},
+		{1920, 1080, 1280, 0, image.Pt(1280, 720)},
+		// Never scaled down to nothing
+		{4000, 10, 100, 0, image.Pt(100, 1)},
+		{10, 4000, 0, 100, image.Pt(1, 100)},
+	}
+	for _, tt := range tests {
+		if got := scaledSize(tt.cols, tt.rows, tt.width, tt.height); got != tt.want {
+			t.Errorf("scaledSize(%d, %d, %d, %d) = %v, want %v", tt.cols, tt.rows, tt.width, tt.height, got, tt.want)
+		}
+	}
+}
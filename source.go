@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// FrameSource is anything gocam can pull frames from: a local capture
+// device, a video file, a folder of stills or a network stream.
+// Read returns io.EOF once a source that does not loop runs out of frames.
+type FrameSource interface {
+	Read(img *gocv.Mat) error
+	Close() error
+	String() string
+}
+
+// openFrameSource parses a source spec and opens the matching FrameSource.
+// Supported forms:
+//
+//	device:0                  local capture device 0 (a bare "0" works too)
+//	file:clips/door.avi       video file, played once
+//	file:clips/door.avi?loop=true&fps=15
+//	dir:stills?fps=2&loop=true
+//	rtsp://host/stream, http://host/video.mjpg
+func openFrameSource(spec string) (FrameSource, error) {
+	if id, err := strconv.Atoi(spec); err == nil {
+		return newDeviceSource(id)
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q: %v", spec, err)
+	}
+
+	// Opaque holds relative paths ("file:clips/a.avi"), Path absolute ones ("file:///a.avi")
+	path := u.Opaque
+	if path == "" {
+		path = u.Path
+	}
+	query := u.Query()
+	loop := query.Get("loop") == "true" || query.Get("loop") == "1"
+	fps, _ := strconv.ParseFloat(query.Get("fps"), 64)
+
+	switch u.Scheme {
+	case "device":
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture device %q", path)
+		}
+		return newDeviceSource(id)
+	case "file":
+		return newFileSource(path, loop, fps)
+	case "dir":
+		return newImageDirSource(path, loop, fps)
+	case "rtsp", "rtsps", "http", "https":
+		return newURLSource(spec)
+	default:
+		return nil, fmt.Errorf("unsupported source %q", spec)
+	}
+}
+
+// framePacer sleeps so that successive frames are delivered no faster than fps.
+type framePacer struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func newFramePacer(fps float64) framePacer {
+	if fps <= 0 {
+		return framePacer{}
+	}
+	return framePacer{interval: time.Duration(float64(time.Second) / fps)}
+}
+
+func (p *framePacer) wait() {
+	if p.interval > 0 && !p.last.IsZero() {
+		if d := p.interval - time.Since(p.last); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	p.last = time.Now()
+}
+
+type deviceSource struct {
+	id      int
+	capture *gocv.VideoCapture
+}
+
+func newDeviceSource(id int) (*deviceSource, error) {
+	capture, err := gocv.VideoCaptureDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceSource{id: id, capture: capture}, nil
+}
+
+func (s *deviceSource) Read(img *gocv.Mat) error {
+	if ok := s.capture.Read(img); !ok {
+		return fmt.Errorf("device closed: %v", s.id)
+	}
+	if img.Empty() {
+		return fmt.Errorf("empty frame from device %v", s.id)
+	}
+	return nil
+}
+
+// Configure applies the capture settings that only make sense for a physical camera.
+func (s *deviceSource) Configure(saturation, fps, brightness, contrast float64) {
+	s.capture.Set(gocv.VideoCaptureSaturation, saturation)
+	s.capture.Set(gocv.VideoCaptureFPS, fps)
+	s.capture.Set(gocv.VideoCaptureBrightness, brightness)
+	s.capture.Set(gocv.VideoCaptureContrast, contrast)
+}
+
+func (s *deviceSource) Close() error {
+	return s.capture.Close()
+}
+
+func (s *deviceSource) String() string {
+	return fmt.Sprintf("device:%d (codec %q)", s.id, s.capture.CodecString())
+}
+
+type fileSource struct {
+	path    string
+	loop    bool
+	capture *gocv.VideoCapture
+	pacer   framePacer
+}
+
+func newFileSource(path string, loop bool, fps float64) (*fileSource, error) {
+	capture, err := gocv.VideoCaptureFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Play back at the file's own rate unless told otherwise
+	if fps <= 0 {
+		fps = capture.Get(gocv.VideoCaptureFPS)
+	}
+	return &fileSource{path: path, loop: loop, capture: capture, pacer: newFramePacer(fps)}, nil
+}
+
+func (s *fileSource) Read(img *gocv.Mat) error {
+	s.pacer.wait()
+	if s.capture.Read(img) && !img.Empty() {
+		return nil
+	}
+	if !s.loop {
+		return io.EOF
+	}
+
+	// Rewind by reopening; not every backend honours seeking back to frame 0
+	s.capture.Close()
+	capture, err := gocv.VideoCaptureFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.capture = capture
+	if !s.capture.Read(img) || img.Empty() {
+		return fmt.Errorf("no frames in %v", s.path)
+	}
+	return nil
+}
+
+func (s *fileSource) Close() error {
+	return s.capture.Close()
+}
+
+func (s *fileSource) String() string {
+	return "file:" + s.path
+}
+
+type imageDirSource struct {
+	dir   string
+	files []string
+	next  int
+	loop  bool
+	pacer framePacer
+}
+
+func newImageDirSource(dir string, loop bool, fps float64) (*imageDirSource, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".jpg", ".jpeg", ".png":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no JPEG or PNG images in %v", dir)
+	}
+	sort.Strings(files)
+
+	if fps <= 0 {
+		fps = 1
+	}
+	return &imageDirSource{dir: dir, files: files, loop: loop, pacer: newFramePacer(fps)}, nil
+}
+
+func (s *imageDirSource) Read(img *gocv.Mat) error {
+	if s.next >= len(s.files) {
+		if !s.loop {
+			return io.EOF
+		}
+		s.next = 0
+	}
+	s.pacer.wait()
+
+	file := s.files[s.next]
+	s.next++
+	still := gocv.IMRead(file, gocv.IMReadColor)
+	defer still.Close()
+	if still.Empty() {
+		return fmt.Errorf("unable to decode image %v", file)
+	}
+	still.CopyTo(img)
+	return nil
+}
+
+func (s *imageDirSource) Close() error {
+	return nil
+}
+
+func (s *imageDirSource) String() string {
+	return "dir:" + s.dir
+}
+
+type urlSource struct {
+	url     string
+	capture *gocv.VideoCapture
+}
+
+func newURLSource(rawurl string) (*urlSource, error) {
+	capture, err := gocv.VideoCaptureFile(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &urlSource{url: rawurl, capture: capture}, nil
+}
+
+func (s *urlSource) Read(img *gocv.Mat) error {
+	if ok := s.capture.Read(img); !ok {
+		return fmt.Errorf("stream closed: %v", s)
+	}
+	if img.Empty() {
+		return fmt.Errorf("empty frame from %v", s)
+	}
+	return nil
+}
+
+func (s *urlSource) Close() error {
+	return s.capture.Close()
+}
+
+func (s *urlSource) String() string {
+	return redactSource(s.url)
+}
+
+// redactSource keeps credentials embedded in a source URL out of the logs.
+func redactSource(spec string) string {
+	if u, err := url.Parse(spec); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		return u.String()
+	}
+	return spec
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PersistentState is what GoCam remembers across restarts: settings
+// changed through the API rather than the configuration file.
+type PersistentState struct {
+	Mode string `json:",omitempty"`
+	// Masks are the privacy masks added through the API, by camera.
+	Masks map[string][]PrivacyMask `json:",omitempty"`
+}
+
+// StateStore keeps PersistentState in a JSON file.
+type StateStore struct {
+	path  string
+	mut   sync.Mutex
+	state PersistentState
+}
+
+var state *StateStore
+
+func openStateStore(path string) (*StateStore, error) {
+	s := &StateStore{path: path}
+	js, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, os.MkdirAll(filepath.Dir(path), 0755)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(js, &s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns a copy of the current state.
+func (s *StateStore) Get() PersistentState {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.state
+}
+
+// Update applies change to the state and writes it to disk. The file is
+// replaced atomically so a crash never leaves it half-written.
+func (s *StateStore) Update(change func(*PersistentState)) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	updated := s.state
+	change(&updated)
+	js, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.state = updated
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certificateRenewBefore is how long before it expires the server
+// certificate is reissued.
+const certificateRenewBefore = 30 * 24 * time.Hour
+
+// ensureSelfSignedCertificate returns the server certificate and key in
+// dir, first creating a private CA and a server certificate signed by it
+// if they do not exist yet. Clients can trust ca.crt once instead of
+// accepting a new self-signed certificate on every device. A server
+// certificate that is about to expire, or does not cover every host, is
+// reissued from the same CA.
+func ensureSelfSignedCertificate(dir string, hosts []string) (string, string, error) {
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if fileExists(certFile) && fileExists(keyFile) {
+		problem := certificateProblem(certFile, certificateHosts(hosts), time.Now())
+		if problem == "" {
+			return certFile, keyFile, nil
+		}
+		log.Printf("[INFO]: Reissuing TLS certificate %v: %v\n", certFile, problem)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	caCert, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template, err := certificateTemplate("GoCam", 825*24*time.Hour)
+	if err != nil {
+		return "", "", err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range certificateHosts(hosts) {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return "", "", err
+	}
+	if err := writeECKey(keyFile, key); err != nil {
+		return "", "", err
+	}
+
+	log.Printf("[INFO]: Generated TLS certificate %v for %v, signed by %v\n",
+		certFile, append(template.DNSNames, ipStrings(template.IPAddresses)...), filepath.Join(dir, "ca.crt"))
+	return certFile, keyFile, nil
+}
+
+// certificateProblem explains why the certificate in certFile must be
+// reissued to serve hosts at now, or is empty if it is still good.
+func certificateProblem(certFile string, hosts []string, now time.Time) string {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err.Error()
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "not a PEM certificate"
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err.Error()
+	}
+	if now.Add(certificateRenewBefore).After(cert.NotAfter) {
+		return "it expires " + cert.NotAfter.Format(time.RFC3339)
+	}
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return "it does not cover " + h
+		}
+	}
+	return ""
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	if fileExists(certFile) && fileExists(keyFile) {
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, nil, fmt.Errorf("invalid CA files in %v", dir)
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certificateTemplate("GoCam Local CA", 10*365*24*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeECKey(keyFile, key); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[INFO]: Generated local certificate authority %v\n", certFile)
+	return cert, key, nil
+}
+
+func certificateTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"GoCam"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+// certificateHosts adds the machine's hostname, localhost and every local
+// interface address to the configured hosts, so the camera can be reached
+// by whatever name or address the LAN knows it by.
+func certificateHosts(hosts []string) []string {
+	all := append([]string{}, hosts...)
+	if name, err := os.Hostname(); err == nil {
+		all = append(all, name, name+".local")
+	}
+	all = append(all, "localhost")
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				all = append(all, ipnet.IP.String())
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, h := range all {
+		if h != "" && !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+func writeECKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := []string{}
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+// redirectToHTTPS sends every plain HTTP request to the same path on the
+// HTTPS port.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host
+		}
+		target := "https://" + net.JoinHostPort(host, httpsPort) + request.URL.RequestURI()
+		http.Redirect(w, request, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readCertificate(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%v is not PEM", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestEnsureSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _, err := ensureSelfSignedCertificate(dir, []string{"cam.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := readCertificate(t, filepath.Join(dir, "ca.crt"))
+	if err := readCertificate(t, certFile).CheckSignatureFrom(ca); err != nil {
+		t.Errorf("server certificate not signed by the CA: %v", err)
+	}
+
+	// Unchanged hosts keep the certificate
+	if _, _, err := ensureSelfSignedCertificate(dir, []string{"cam.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ioutil.ReadFile(certFile); !bytes.Equal(again, first) {
+		t.Errorf("certificate reissued although nothing changed")
+	}
+
+	// A new host gets a new certificate from the same CA
+	if _, _, err := ensureSelfSignedCertificate(dir, []string{"cam.example", "door.example"}); err != nil {
+		t.Fatal(err)
+	}
+	cert := readCertificate(t, certFile)
+	if err := cert.VerifyHostname("door.example"); err != nil {
+		t.Errorf("reissued certificate: %v", err)
+	}
+	if err := cert.CheckSignatureFrom(readCertificate(t, filepath.Join(dir, "ca.crt"))); err != nil {
+		t.Errorf("reissued certificate not signed by the original CA: %v", err)
+	}
+	if !readCertificate(t, filepath.Join(dir, "ca.crt")).Equal(ca) {
+		t.Errorf("CA replaced when reissuing the server certificate")
+	}
+}
+
+func TestCertificateProblem(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _, err := ensureSelfSignedCertificate(dir, []string{"cam.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := readCertificate(t, certFile).NotAfter
+
+	tests := []struct {
+		name    string
+		hosts   []string
+		now     time.Time
+		problem bool
+	}{
+		{"good", []string{"cam.example", "localhost"}, time.Now(), false},
+		{"missing host", []string{"door.example"}, time.Now(), true},
+		{"about to expire", []string{"cam.example"}, notAfter.Add(-24 * time.Hour), true},
+		{"expired", []string{"cam.example"}, notAfter.Add(time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := certificateProblem(certFile, tt.hosts, tt.now); (got != "") != tt.problem {
+			t.Errorf("%v: certificateProblem() = %q", tt.name, got)
+		}
+	}
+	if got := certificateProblem(filepath.Join(dir, "missing.crt"), nil, time.Now()); got == "" {
+		t.Errorf("missing certificate reported as good")
+	}
+}
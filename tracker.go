@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TrackingConfig is the tracking: section. Detections of the same label
+// in consecutive frames are joined into tracks by box overlap (IoU), or by
+// how far their centres moved when the boxes no longer overlap.
+type TrackingConfig struct {
+	Enabled bool
+	// MinIoU is the overlap needed to continue a track.
+	MinIoU float64
+	// MaxDistance is how far, as a fraction of the frame's diagonal, a
+	// box's centre may move between frames and still continue a track.
+	MaxDistance float64
+	// MinHits is how many frames a track needs before it is confirmed,
+	// gets an ID and raises an event; shorter tracks are noise.
+	MinHits int
+	// MaxAge is how long a track may go unseen before it ends.
+	MaxAge time.Duration
+	// MaxPath caps the points kept for a track's path; longer paths are
+	// thinned out.
+	MaxPath int
+}
+
+func (c TrackingConfig) validate() error {
+	if c.MinIoU <= 0 || c.MinIoU > 1 {
+		return fmt.Errorf("tracking.minIoU must be between 0 and 1")
+	}
+	if c.MaxDistance < 0 || c.MaxDistance > 1 {
+		return fmt.Errorf("tracking.maxDistance must be between 0 and 1")
+	}
+	if c.MinHits < 1 || c.MaxAge <= 0 || c.MaxPath < 2 {
+		return fmt.Errorf("tracking.minHits, tracking.maxAge and tracking.maxPath must be positive")
+	}
+	return nil
+}
+
+// Track follows one object across frames.
+type Track struct {
+	ID    int
+	Label string
+	// Zone is the zone the object was last seen in and ZoneSince when it
+	// entered it.
+	Zone       string    `json:",omitempty"`
+	ZoneSince  time.Time `json:",omitempty"`
+	Box        image.Rectangle
+	Confidence float64 `json:",omitempty"`
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	// Dwell is how long the object has been in view, in seconds.
+	Dwell float64
+	// Path is the centre of the box over time.
+	Path []image.Point
+	// Ended is set once the track has not been seen for tracking.maxAge.
+	Ended bool `json:",omitempty"`
+
+	hits     int
+	previous image.Point
+}
+
+func (t *Track) update(d Detection, now time.Time, maxPath int) {
+	t.previous = centre(t.Box)
+	t.Box = d.Box
+	t.Confidence = d.Confidence
+	if d.Zone != t.Zone || t.ZoneSince.IsZero() {
+		t.Zone, t.ZoneSince = d.Zone, now
+	}
+	t.LastSeen = now
+	t.Dwell = now.Sub(t.FirstSeen).Seconds()
+	t.hits++
+	if len(t.Path) >= maxPath {
+		// Keep every other point so the whole path survives, more coarsely
+		thinned := t.Path[:0]
+		for i := 0; i < len(t.Path); i += 2 {
+			thinned = append(thinned, t.Path[i])
+		}
+		t.Path = thinned
+	}
+	t.Path = append(t.Path, centre(d.Box))
+}
+
+func (t *Track) snapshot() Track {
+	s := *t
+	s.Path = append([]image.Point{}, t.Path...)
+	return s
+}
+
+func centre(r image.Rectangle) image.Point {
+	return image.Pt((r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2)
+}
+
+// TrackMove is how far a confirmed track's centre moved in one frame.
+type TrackMove struct {
+	Track    Track
+	From, To image.Point
+}
+
+// TrackUpdate is what changed in one frame.
+type TrackUpdate struct {
+	Started []Track
+	Ended   []Track
+	Moved   []TrackMove
+}
+
+// Tracker assigns stable IDs to one camera's detections.
+type Tracker struct {
+	config TrackingConfig
+	mut    sync.Mutex
+	tracks []*Track
+	nextID int
+}
+
+func newTracker(cfg TrackingConfig) *Tracker {
+	return &Tracker{config: cfg, nextID: 1}
+}
+
+// Update matches a frame's detections to the current tracks, setting each
+// detection's Track to its track's ID once confirmed. It returns the
+// tracks confirmed, ended and moved by this frame.
+func (t *Tracker) Update(now time.Time, detections []Detection, cols, rows int) TrackUpdate {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	// Score every pairing of track and detection of the same label
+	type pair struct {
+		track, detection int
+		score            float64
+	}
+	maxDistance := t.config.MaxDistance * math.Hypot(float64(cols), float64(rows))
+	pairs := []pair{}
+	for i, track := range t.tracks {
+		for j, d := range detections {
+			if track.Label != d.Label {
+				continue
+			}
+			if overlap := iou(track.Box, d.Box); overlap >= t.config.MinIoU {
+				// Overlapping boxes always beat centre distance
+				pairs = append(pairs, pair{i, j, 1 + overlap})
+			} else if dist := distance(centre(track.Box), centre(d.Box)); dist <= maxDistance {
+				pairs = append(pairs, pair{i, j, 1 - dist/(maxDistance+1)})
+			}
+		}
+	}
+	sort.Slice(pairs, func(a, b int) bool { return pairs[a].score > pairs[b].score })
+
+	// Greedily take the best pairs
+	trackMatched := make([]bool, len(t.tracks))
+	detectionMatched := make([]bool, len(detections))
+	for _, p := range pairs {
+		if trackMatched[p.track] || detectionMatched[p.detection] {
+			continue
+		}
+		trackMatched[p.track], detectionMatched[p.detection] = true, true
+		t.tracks[p.track].update(detections[p.detection], now, t.config.MaxPath)
+	}
+
+	// Unmatched detections start tentative tracks
+	for j, d := range detections {
+		if !detectionMatched[j] {
+			track := &Track{Label: d.Label, FirstSeen: now}
+			track.update(d, now, t.config.MaxPath)
+			t.tracks = append(t.tracks, track)
+		}
+	}
+
+	// Confirm tracks with enough hits and end those unseen for too long
+	var update TrackUpdate
+	kept := t.tracks[:0]
+	for _, track := range t.tracks {
+		if now.Sub(track.LastSeen) > t.config.MaxAge {
+			if track.ID != 0 {
+				track.Ended = true
+				update.Ended = append(update.Ended, track.snapshot())
+			}
+			continue
+		}
+		if track.ID == 0 && track.hits >= t.config.MinHits {
+			track.ID = t.nextID
+			t.nextID++
+			update.Started = append(update.Started, track.snapshot())
+		}
+		if track.ID != 0 && track.LastSeen.Equal(now) && track.hits > 1 {
+			update.Moved = append(update.Moved, TrackMove{Track: track.snapshot(), From: track.previous, To: centre(track.Box)})
+		}
+		kept = append(kept, track)
+	}
+	t.tracks = kept
+
+	// Tag this frame's detections with their confirmed tracks
+	for _, track := range t.tracks {
+		if track.ID == 0 || !track.LastSeen.Equal(now) {
+			continue
+		}
+		for j := range detections {
+			if detections[j].Box == track.Box && detections[j].Label == track.Label {
+				detections[j].Track = track.ID
+			}
+		}
+	}
+	return update
+}
+
+func distance(a, b image.Point) float64 {
+	return math.Hypot(float64(a.X-b.X), float64(a.Y-b.Y))
+}
+
+// Active returns the confirmed tracks, oldest first.
+func (t *Tracker) Active() []Track {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	active := []Track{}
+	for _, track := range t.tracks {
+		if track.ID != 0 {
+			active = append(active, track.snapshot())
+		}
+	}
+	return active
+}
+
+type TracksResponse struct {
+	Camera string
+	Tracks []Track
+}
+
+func tracksHandler(w http.ResponseWriter, request *http.Request, cam *Camera) {
+	if cam.tracker == nil {
+		http.Error(w, "tracking is not enabled for this camera", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, TracksResponse{cam.ID, cam.tracker.Active()})
+}
+
+// TracksHandler serves GET /api/tracks: the primary camera's active tracks.
+func TracksHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	tracksHandler(w, request, primaryCamera())
+}
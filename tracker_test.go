@@ -0,0 +1,193 @@
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+var testTracking = TrackingConfig{Enabled: true, MinIoU: 0.3, MaxDistance: 0.1, MinHits: 3, MaxAge: 2 * time.Second, MaxPath: 200}
+
+// box is a 40x40 detection at x, y on a 640x480 frame, whose diagonal makes
+// maxDistance 80 pixels.
+func box(label string, x, y int) Detection {
+	return Detection{Label: label, Box: image.Rect(x, y, x+40, y+40)}
+}
+
+func TestTrackerUpdate(t *testing.T) {
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	frame := func(i int) time.Time { return start.Add(time.Duration(i) * 100 * time.Millisecond) }
+
+	type step struct {
+		detections []Detection
+		// tracks are the IDs the detections should be tagged with
+		tracks  []int
+		started []int
+		ended   []int
+		moved   []int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// gap is extra time before the last step
+		gap time.Duration
+	}{
+		{"confirmed after minHits", []step{
+			{[]Detection{box("person", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("person", 105, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("person", 110, 100)}, []int{1}, []int{1}, nil, []int{1}},
+			{[]Detection{box("person", 115, 100)}, []int{1}, nil, nil, []int{1}},
+		}, 0},
+		{"follows centres when boxes stop overlapping", []step{
+			{[]Detection{box("car", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("car", 150, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("car", 200, 100)}, []int{1}, []int{1}, nil, []int{1}},
+		}, 0},
+		{"too far to continue", []step{
+			{[]Detection{box("car", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("car", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("car", 300, 300)}, []int{0}, nil, nil, nil},
+		}, 0},
+		{"labels are tracked separately", []step{
+			{[]Detection{box("person", 100, 100), box("dog", 100, 100)}, []int{0, 0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 100), box("dog", 100, 100)}, []int{0, 0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 100), box("dog", 100, 100)}, []int{1, 2}, []int{1, 2}, nil, []int{1, 2}},
+		}, 0},
+		{"two objects keep their IDs", []step{
+			{[]Detection{box("person", 100, 100), box("person", 400, 100)}, []int{0, 0}, nil, nil, nil},
+			{[]Detection{box("person", 400, 105), box("person", 100, 105)}, []int{0, 0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 110), box("person", 400, 110)}, []int{1, 2}, []int{1, 2}, nil, []int{1, 2}},
+			{[]Detection{box("person", 400, 115), box("person", 100, 115)}, []int{2, 1}, nil, nil, []int{1, 2}},
+		}, 0},
+		{"ends after maxAge unseen", []step{
+			{[]Detection{box("person", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 100)}, []int{1}, []int{1}, nil, []int{1}},
+			{nil, nil, nil, []int{1}, nil},
+		}, 3 * time.Second},
+		{"survives a short gap", []step{
+			{[]Detection{box("person", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 100)}, []int{0}, nil, nil, nil},
+			{[]Detection{box("person", 100, 100)}, []int{1}, []int{1}, nil, []int{1}},
+			{[]Detection{box("person", 105, 100)}, []int{1}, nil, nil, []int{1}},
+		}, time.Second},
+		{"unconfirmed tracks end silently", []step{
+			{[]Detection{box("person", 100, 100)}, []int{0}, nil, nil, nil},
+			{nil, nil, nil, nil, nil},
+		}, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTracker(testTracking)
+			for i, s := range tt.steps {
+				now := frame(i)
+				if i == len(tt.steps)-1 {
+					now = now.Add(tt.gap)
+				}
+				update := tracker.Update(now, s.detections, 640, 480)
+
+				for j, d := range s.detections {
+					if d.Track != s.tracks[j] {
+						t.Errorf("step %d: detection %d has track %d, want %d", i, j, d.Track, s.tracks[j])
+					}
+				}
+				checkIDs(t, i, "started", trackIDs(update.Started), s.started)
+				checkIDs(t, i, "ended", trackIDs(update.Ended), s.ended)
+				moved := []int{}
+				for _, m := range update.Moved {
+					moved = append(moved, m.Track.ID)
+				}
+				checkIDs(t, i, "moved", moved, s.moved)
+			}
+		})
+	}
+}
+
+func trackIDs(tracks []Track) []int {
+	ids := []int{}
+	for _, track := range tracks {
+		ids = append(ids, track.ID)
+	}
+	return ids
+}
+
+func checkIDs(t *testing.T, step int, what string, got, want []int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("step %d: %v %v, want %v", step, what, got, want)
+		return
+	}
+	seen := map[int]bool{}
+	for _, id := range got {
+		seen[id] = true
+	}
+	for _, id := range want {
+		if !seen[id] {
+			t.Errorf("step %d: %v %v, want %v", step, what, got, want)
+			return
+		}
+	}
+}
+
+func TestTrackerTrackDetails(t *testing.T) {
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newTracker(testTracking)
+
+	var update TrackUpdate
+	for i := 0; i < 4; i++ {
+		d := box("person", 100+10*i, 100)
+		d.Zone = "porch"
+		if i == 3 {
+			d.Zone = "drive"
+		}
+		update = tracker.Update(start.Add(time.Duration(i)*time.Second), []Detection{d}, 640, 480)
+	}
+
+	if len(update.Moved) != 1 {
+		t.Fatalf("got %d moves, want 1", len(update.Moved))
+	}
+	move := update.Moved[0]
+	if move.From != image.Pt(140, 120) || move.To != image.Pt(150, 120) {
+		t.Errorf("moved from %v to %v, want (140,120) to (150,120)", move.From, move.To)
+	}
+
+	active := tracker.Active()
+	if len(active) != 1 {
+		t.Fatalf("got %d active tracks, want 1", len(active))
+	}
+	track := active[0]
+	if track.ID != 1 || track.Label != "person" || track.Dwell != 3 {
+		t.Errorf("track = %+v, want person 1 seen for 3s", track)
+	}
+	if track.Zone != "drive" || !track.ZoneSince.Equal(start.Add(3*time.Second)) {
+		t.Errorf("track in %q since %v, want drive since the last frame", track.Zone, track.ZoneSince)
+	}
+	if len(track.Path) != 4 || track.Path[0] != image.Pt(120, 120) {
+		t.Errorf("path = %v, want the four centres from (120,120)", track.Path)
+	}
+
+	// Active returns copies
+	track.Path[0] = image.Pt(0, 0)
+	if tracker.Active()[0].Path[0] != image.Pt(120, 120) {
+		t.Errorf("changing a returned path changed the track")
+	}
+}
+
+func TestTrackerPathThinning(t *testing.T) {
+	cfg := testTracking
+	cfg.MaxPath = 8
+	tracker := newTracker(cfg)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		tracker.Update(start.Add(time.Duration(i)*100*time.Millisecond), []Detection{box("car", 10+i, 100)}, 640, 480)
+	}
+
+	path := tracker.Active()[0].Path
+	if len(path) > cfg.MaxPath {
+		t.Errorf("path has %d points, want at most %d", len(path), cfg.MaxPath)
+	}
+	// The whole path survives, more coarsely
+	if first, last := path[0], path[len(path)-1]; first != image.Pt(30, 120) || last != image.Pt(79, 120) {
+		t.Errorf("path runs from %v to %v, want (30,120) to (79,120)", first, last)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// LineConfig is a virtual tripwire. Points are normalized to 0..1 of the
+// frame. Looking from From towards To, a tracked object crossing from the
+// left side to the right side goes "in"; the other way goes "out".
+type LineConfig struct {
+	Name string
+	From [2]float64
+	To   [2]float64
+	// Labels that are counted, e.g. person; empty counts every label.
+	Labels []string
+	// MinDistance is how far, as a fraction of the frame's diagonal, an
+	// object's centre must get past the line to count as on the other side
+	// (default 0.02), so an object jittering on the line is not counted.
+	MinDistance float64
+}
+
+func (l *LineConfig) validate() error {
+	if !validCameraID(l.Name) {
+		return fmt.Errorf("invalid line name %q: use letters, digits, - and _", l.Name)
+	}
+	for _, p := range [][2]float64{l.From, l.To} {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return fmt.Errorf("line %v: points must be between 0 and 1", l.Name)
+		}
+	}
+	if l.From == l.To {
+		return fmt.Errorf("line %v: from and to must differ", l.Name)
+	}
+	if l.MinDistance == 0 {
+		l.MinDistance = 0.02
+	}
+	if l.MinDistance < 0 || l.MinDistance > 1 {
+		return fmt.Errorf("line %v: minDistance must be between 0 and 1", l.Name)
+	}
+	return nil
+}
+
+// Crossing is a tracked object going over a line.
+type Crossing struct {
+	Line      string
+	Direction string
+	Track     Track
+}
+
+// lineSide is the side of a line a track was last clearly on, and where.
+type lineSide struct {
+	right bool
+	at    [2]float64
+}
+
+// LineSet is one camera's tripwires.
+type LineSet struct {
+	lines []LineConfig
+	// sides remembers the side of each line each track is on
+	sides map[string]map[int]lineSide
+}
+
+func newLineSet(lines []LineConfig) (*LineSet, error) {
+	set := &LineSet{sides: map[string]map[int]lineSide{}}
+	for _, line := range lines {
+		if err := line.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := set.sides[line.Name]; ok {
+			return nil, fmt.Errorf("line %v already exists", line.Name)
+		}
+		set.lines = append(set.lines, line)
+		set.sides[line.Name] = map[int]lineSide{}
+	}
+	return set, nil
+}
+
+func (s *LineSet) segment(l LineConfig, cols, rows int) (a, b [2]float64) {
+	return [2]float64{l.From[0] * float64(cols), l.From[1] * float64(rows)},
+		[2]float64{l.To[0] * float64(cols), l.To[1] * float64(rows)}
+}
+
+// rightOf reports whether p is on the right of a->b in image coordinates
+// (y down). Points on the line count as right.
+func rightOf(a, b [2]float64, p [2]float64) bool {
+	return sideDistance(a, b, p) >= 0
+}
+
+// sideDistance is how far p is from the line through a and b, positive on
+// its right.
+func sideDistance(a, b [2]float64, p [2]float64) float64 {
+	return ((b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])) / math.Hypot(b[0]-a[0], b[1]-a[1])
+}
+
+// Cross returns the crossings made by this frame's track movements on a
+// cols x rows frame. A track is placed on a side of each line from its
+// first sighting, so an object that crossed before its track was
+// confirmed is still counted, and only changes side once it is
+// MinDistance past the line.
+func (s *LineSet) Cross(moves []TrackMove, cols, rows int) []Crossing {
+	crossings := []Crossing{}
+	for _, line := range s.lines {
+		a, b := s.segment(line, cols, rows)
+		minDistance := line.MinDistance * math.Hypot(float64(cols), float64(rows))
+		sides := s.sides[line.Name]
+		for _, move := range moves {
+			if len(line.Labels) > 0 && !contains(line.Labels, move.Track.Label) {
+				continue
+			}
+			points := []image.Point{move.From, move.To}
+			if _, ok := sides[move.Track.ID]; !ok && len(move.Track.Path) > 0 {
+				points = move.Track.Path
+			}
+			for _, pt := range points {
+				p := [2]float64{float64(pt.X), float64(pt.Y)}
+				d := sideDistance(a, b, p)
+				if math.Abs(d) < minDistance {
+					continue
+				}
+				last, ok := sides[move.Track.ID]
+				sides[move.Track.ID] = lineSide{d > 0, p}
+				if !ok || last.right == (d > 0) {
+					continue
+				}
+				// The movement crosses the infinite line; check it is within the segment
+				if rightOf(last.at, p, a) == rightOf(last.at, p, b) {
+					continue
+				}
+
+				direction := "out"
+				if d > 0 {
+					direction = "in"
+				}
+				crossings = append(crossings, Crossing{Line: line.Name, Direction: direction, Track: move.Track})
+			}
+		}
+	}
+	return crossings
+}
+
+// Forget drops the sides of tracks that ended.
+func (s *LineSet) Forget(ended []Track) {
+	for _, track := range ended {
+		for _, sides := range s.sides {
+			delete(sides, track.ID)
+		}
+	}
+}
+
+// Draw marks the lines on the frame with their names.
+func (s *LineSet) Draw(img *gocv.Mat) {
+	yellow := color.RGBA{R: 255, G: 255, A: 255}
+	for _, line := range s.lines {
+		a, b := s.segment(line, img.Cols(), img.Rows())
+		from, to := image.Pt(int(a[0]), int(a[1])), image.Pt(int(b[0]), int(b[1]))
+		gocv.Line(img, from, to, yellow, 2)
+		gocv.PutText(img, line.Name, from.Add(image.Pt(4, -4)), gocv.FontHersheySimplex, 0.5, yellow, 1)
+	}
+}
+
+type CounterBucket struct {
+	Start time.Time
+	In    int
+	Out   int
+}
+
+type LineCounter struct {
+	Camera  string
+	Line    string
+	In      int
+	Out     int
+	Buckets []CounterBucket
+}
+
+type CountersResponse struct {
+	Since  time.Time
+	Until  time.Time
+	Bucket string
+	Lines  []LineCounter
+}
+
+// maxCounterBuckets keeps a typo in bucket from building a huge response.
+const maxCounterBuckets = 1000
+
+// bucketStart aligns the first bucket. Buckets of whole days start at
+// midnight in the schedule time zone.
+func bucketStart(t time.Time, bucket time.Duration) time.Time {
+	if bucket%(24*time.Hour) != 0 {
+		return t.Truncate(bucket)
+	}
+	t = t.In(scheduler.location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, scheduler.location)
+}
+
+// CountersHandler serves GET /api/counters?camera=&bucket=1h&since=&until=:
+// line crossings per line, in and out, in time buckets. since and until
+// are RFC 3339 times and default to the last 24 hours.
+func CountersHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	query := request.URL.Query()
+
+	bucket := time.Hour
+	if v := query.Get("bucket"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			http.Error(w, "invalid bucket: expected a duration of at least 1m", http.StatusBadRequest)
+			return
+		}
+		bucket = d
+	}
+	until := time.Now()
+	since := until.Add(-24 * time.Hour)
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %v: expected RFC 3339 time", bound.name), http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+	if !since.Before(until) {
+		http.Error(w, "since must be before until", http.StatusBadRequest)
+		return
+	}
+	first := bucketStart(since, bucket)
+	count := int(until.Sub(first)/bucket) + 1
+	if count > maxCounterBuckets {
+		http.Error(w, fmt.Sprintf("too many buckets: at most %d", maxCounterBuckets), http.StatusBadRequest)
+		return
+	}
+
+	// Every configured line is listed, with empty buckets included
+	camera := query.Get("camera")
+	resp := CountersResponse{Since: since, Until: until, Bucket: bucket.String(), Lines: []LineCounter{}}
+	index := map[string]*LineCounter{}
+	for _, cam := range cameras {
+		if camera != "" && cam.ID != camera {
+			continue
+		}
+		for _, line := range cam.lines.lines {
+			counter := LineCounter{Camera: cam.ID, Line: line.Name, Buckets: make([]CounterBucket, count)}
+			for i := range counter.Buckets {
+				counter.Buckets[i].Start = first.Add(time.Duration(i) * bucket)
+			}
+			resp.Lines = append(resp.Lines, counter)
+		}
+	}
+	for i := range resp.Lines {
+		index[resp.Lines[i].Camera+"/"+resp.Lines[i].Line] = &resp.Lines[i]
+	}
+
+	// Count while reading the log rather than loading every crossing
+	err := eventLog.scan(EventFilter{Camera: camera, Kind: "crossing", Since: since, Until: until}, func(e Event) {
+		counter, ok := index[e.Camera+"/"+e.Line]
+		if !ok {
+			return
+		}
+		i := int(e.Time.Sub(first) / bucket)
+		if i < 0 || i >= count {
+			return
+		}
+		if e.Direction == "in" {
+			counter.In++
+			counter.Buckets[i].In++
+		} else {
+			counter.Out++
+			counter.Buckets[i].Out++
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func move(id int, label string, from, to image.Point) TrackMove {
+	return TrackMove{Track: Track{ID: id, Label: label}, From: from, To: to}
+}
+
+func TestLineSetCross(t *testing.T) {
+	// A door down the middle of a 100x100 frame. Looking from the top down,
+	// the left side is on the right of the frame, so walking from x=60 to
+	// x=40 goes in.
+	door := LineConfig{Name: "door", From: [2]float64{0.5, 0}, To: [2]float64{0.5, 0.6}}
+	pets := LineConfig{Name: "flap", From: [2]float64{0.5, 0}, To: [2]float64{0.5, 0.6}, Labels: []string{"cat", "dog"}}
+	wide := LineConfig{Name: "door", From: [2]float64{0.5, 0}, To: [2]float64{0.5, 0.6}, MinDistance: 0.05}
+
+	// A fast object is confirmed as a track only once it is already past
+	// the line; its path still has where it was first seen.
+	fast := move(1, "person", image.Pt(45, 30), image.Pt(30, 30))
+	fast.Track.Path = []image.Point{image.Pt(70, 30), image.Pt(45, 30), image.Pt(30, 30)}
+
+	type crossing struct {
+		line, direction string
+		track           int
+	}
+	tests := []struct {
+		name  string
+		lines []LineConfig
+		moves [][]TrackMove
+		want  [][]crossing
+	}{
+		{"in", []LineConfig{door},
+			[][]TrackMove{{move(1, "person", image.Pt(60, 30), image.Pt(40, 30))}},
+			[][]crossing{{{"door", "in", 1}}}},
+		{"out", []LineConfig{door},
+			[][]TrackMove{{move(1, "person", image.Pt(40, 30), image.Pt(60, 30))}},
+			[][]crossing{{{"door", "out", 1}}}},
+		{"same side", []LineConfig{door},
+			[][]TrackMove{{move(1, "person", image.Pt(10, 30), image.Pt(20, 30))}},
+			[][]crossing{{}}},
+		{"past the end of the line", []LineConfig{door},
+			[][]TrackMove{{move(1, "person", image.Pt(60, 80), image.Pt(40, 80))}},
+			[][]crossing{{}}},
+		{"stopping on the line counts once", []LineConfig{door},
+			[][]TrackMove{
+				{move(1, "person", image.Pt(60, 30), image.Pt(50, 30))},
+				{move(1, "person", image.Pt(50, 30), image.Pt(40, 30))},
+			},
+			[][]crossing{{}, {{"door", "in", 1}}}},
+		{"jitter on the line", []LineConfig{wide},
+			[][]TrackMove{
+				{move(1, "person", image.Pt(52, 30), image.Pt(48, 30))},
+				{move(1, "person", image.Pt(48, 30), image.Pt(52, 30))},
+				{move(1, "person", image.Pt(52, 30), image.Pt(48, 30))},
+			},
+			[][]crossing{{}, {}, {}}},
+		{"crossed before being confirmed", []LineConfig{door},
+			[][]TrackMove{{fast}},
+			[][]crossing{{{"door", "in", 1}}}},
+		{"back and forth", []LineConfig{door},
+			[][]TrackMove{
+				{move(1, "person", image.Pt(60, 30), image.Pt(40, 30))},
+				{move(1, "person", image.Pt(40, 30), image.Pt(60, 30))},
+			},
+			[][]crossing{{{"door", "in", 1}}, {{"door", "out", 1}}}},
+		{"around the end of the line and back in", []LineConfig{door},
+			[][]TrackMove{
+				{move(1, "person", image.Pt(60, 30), image.Pt(40, 30))},
+				{move(1, "person", image.Pt(40, 80), image.Pt(60, 80))},
+				{move(1, "person", image.Pt(60, 30), image.Pt(40, 30))},
+			},
+			[][]crossing{{{"door", "in", 1}}, {}, {{"door", "in", 1}}}},
+		{"each track counts", []LineConfig{door},
+			[][]TrackMove{{
+				move(1, "person", image.Pt(60, 30), image.Pt(40, 30)),
+				move(2, "person", image.Pt(60, 20), image.Pt(40, 20)),
+			}},
+			[][]crossing{{{"door", "in", 1}, {"door", "in", 2}}}},
+		{"labels filter", []LineConfig{door, pets},
+			[][]TrackMove{{
+				move(1, "person", image.Pt(60, 30), image.Pt(40, 30)),
+				move(2, "cat", image.Pt(40, 20), image.Pt(60, 20)),
+			}},
+			[][]crossing{{{"door", "in", 1}, {"door", "out", 2}, {"flap", "out", 2}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := newLineSet(tt.lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, moves := range tt.moves {
+				got := set.Cross(moves, 100, 100)
+				if len(got) != len(tt.want[i]) {
+					t.Fatalf("step %d: got %d crossings %+v, want %+v", i, len(got), got, tt.want[i])
+				}
+				for j, c := range got {
+					want := tt.want[i][j]
+					if c.Line != want.line || c.Direction != want.direction || c.Track.ID != want.track {
+						t.Errorf("step %d: crossing %d = %v %v by %d, want %v %v by %d", i, j, c.Line, c.Direction, c.Track.ID, want.line, want.direction, want.track)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLineSetForget(t *testing.T) {
+	set, err := newLineSet([]LineConfig{{Name: "door", From: [2]float64{0.5, 0}, To: [2]float64{0.5, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Cross([]TrackMove{move(1, "person", image.Pt(60, 30), image.Pt(40, 30))}, 100, 100)
+	if _, ok := set.sides["door"][1]; !ok {
+		t.Fatal("side of track 1 not remembered")
+	}
+
+	// Tracks that ended must not be remembered forever
+	set.Forget([]Track{{ID: 1}})
+	if _, ok := set.sides["door"][1]; ok {
+		t.Errorf("side of track 1 remembered after Forget")
+	}
+}
+
+func TestNewLineSetErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []LineConfig
+	}{
+		{"invalid name", []LineConfig{{Name: "front door", To: [2]float64{1, 1}}}},
+		{"point outside the frame", []LineConfig{{Name: "door", To: [2]float64{1.5, 1}}}},
+		{"zero length", []LineConfig{{Name: "door", From: [2]float64{0.5, 0.5}, To: [2]float64{0.5, 0.5}}}},
+		{"min distance", []LineConfig{{Name: "door", To: [2]float64{1, 1}, MinDistance: 1.5}}},
+		{"duplicate", []LineConfig{{Name: "door", To: [2]float64{1, 1}}, {Name: "door", To: [2]float64{0, 1}}}},
+	}
+	for _, tt := range tests {
+		if _, err := newLineSet(tt.lines); err == nil {
+			t.Errorf("%v: newLineSet() succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// WebhookConfig is one entry of the webhooks: list.
+type WebhookConfig struct {
+	Name string
+	URL  string
+	// Secret signs every payload with HMAC-SHA256 when set.
+	Secret string
+	// Kinds and Cameras restrict which events are sent; empty means all.
+	Kinds   []string
+	Cameras []string
+	// Cooldown is the minimum gap between two deliveries to this hook.
+	Cooldown time.Duration
+	Retries  int
+	Timeout  time.Duration
+	// Snapshot is "base64" (embed the JPEG), "url" (link to it) or "none".
+	Snapshot string
+}
+
+func (cfg WebhookConfig) wants(e Event) bool {
+	return (len(cfg.Kinds) == 0 || contains(cfg.Kinds, e.Kind)) &&
+		(len(cfg.Cameras) == 0 || contains(cfg.Cameras, e.Camera))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body POSTed to every hook.
+type WebhookPayload struct {
+	ID           string
+	Type         string
+	Time         time.Time
+	Camera       string
+	Detections   []Detection
+	Track        *Track  `json:",omitempty"`
+	Line         string  `json:",omitempty"`
+	Direction    string  `json:",omitempty"`
+	Rule         string  `json:",omitempty"`
+	Dwell        float64 `json:",omitempty"`
+	Clip         string  `json:",omitempty"`
+	SnapshotURL  string  `json:",omitempty"`
+	SnapshotJPEG []byte  `json:",omitempty"`
+}
+
+// WebhookDelivery is one attempt to deliver an event, as kept in the delivery log.
+type WebhookDelivery struct {
+	Time     time.Time
+	Hook     string
+	Event    string
+	Attempt  int
+	Status   int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+}
+
+type webhook struct {
+	config   WebhookConfig
+	queue    chan Event
+	lastSent time.Time
+}
+
+// Notifier fans events out to the configured webhooks. Each hook has its
+// own queue and goroutine so a slow receiver cannot hold up the others or
+// the capture loop.
+type Notifier struct {
+	hooks     []*webhook
+	client    *http.Client
+	publicURL string
+	// backoff is the wait before the first retry; it doubles after each
+	backoff time.Duration
+
+	logMut     sync.Mutex
+	logPath    string
+	logMaxSize int64
+	// recent is a ring of the last maxDeliveries attempts; next is where
+	// the next one goes
+	recent []WebhookDelivery
+	next   int
+}
+
+// maxDeliveries caps the delivery attempts kept in memory for
+// /api/webhooks/deliveries.
+const maxDeliveries = 500
+
+func loadWebhookConfigs() ([]WebhookConfig, error) {
+	configs := []WebhookConfig{}
+	if err := viper.UnmarshalKey("webhooks", &configs); err != nil {
+		return nil, err
+	}
+	for i := range configs {
+		cfg := &configs[i]
+		if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+			return nil, fmt.Errorf("webhooks[%d]: invalid url %q", i, cfg.URL)
+		}
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("hook%d", i)
+		}
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = 10 * time.Second
+		}
+		if cfg.Snapshot == "" {
+			cfg.Snapshot = "url"
+		}
+		if cfg.Snapshot != "base64" && cfg.Snapshot != "url" && cfg.Snapshot != "none" {
+			return nil, fmt.Errorf("webhooks[%d]: snapshot must be base64, url or none", i)
+		}
+	}
+	return configs, nil
+}
+
+func newNotifier(configs []WebhookConfig, publicURL, logPath string, logMaxSize int64) (*Notifier, error) {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return nil, err
+	}
+
+	n := &Notifier{client: &http.Client{}, publicURL: publicURL, backoff: time.Second, logPath: logPath, logMaxSize: logMaxSize}
+	if err := n.loadDeliveries(); err != nil {
+		return nil, err
+	}
+	for _, cfg := range configs {
+		hook := &webhook{config: cfg, queue: make(chan Event, 100)}
+		n.hooks = append(n.hooks, hook)
+		go n.deliverAll(hook)
+	}
+	return n, nil
+}
+
+// Notify queues the event for every hook that wants it. It never blocks;
+// when a hook has fallen far behind the event is dropped for that hook.
+func (n *Notifier) Notify(e Event) {
+	for _, hook := range n.hooks {
+		if !hook.config.wants(e) {
+			continue
+		}
+		select {
+		case hook.queue <- e:
+		default:
+			log.Printf("[WARN]: Webhook %v queue full; dropping event %v\n", hook.config.Name, e.ID)
+		}
+	}
+}
+
+func (n *Notifier) deliverAll(hook *webhook) {
+	for e := range hook.queue {
+		if e.Time.Sub(hook.lastSent) < hook.config.Cooldown {
+			continue
+		}
+		hook.lastSent = e.Time
+		n.deliver(hook.config, e)
+	}
+}
+
+// deliver POSTs the event, retrying with exponential backoff on network
+// errors, 429 and 5xx responses.
+func (n *Notifier) deliver(cfg WebhookConfig, e Event) {
+	body, err := json.Marshal(n.payload(cfg, e))
+	if err != nil {
+		log.Printf("[ERROR]: Webhook %v: %v\n", cfg.Name, err)
+		return
+	}
+
+	backoff := n.backoff
+	for attempt := 1; attempt <= cfg.Retries+1; attempt++ {
+		start := time.Now()
+		status, err := n.post(cfg, body, e.ID)
+		delivery := WebhookDelivery{Time: start, Hook: cfg.Name, Event: e.ID, Attempt: attempt, Status: status, Duration: time.Since(start)}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		n.logDelivery(delivery)
+
+		if err == nil && status < 300 {
+			return
+		}
+		if err == nil && status != http.StatusTooManyRequests && status < 500 {
+			log.Printf("[ERROR]: Webhook %v rejected event %v with status %d\n", cfg.Name, e.ID, status)
+			return
+		}
+		if attempt <= cfg.Retries {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		}
+	}
+	log.Printf("[ERROR]: Webhook %v failed to deliver event %v after %d attempts\n", cfg.Name, e.ID, cfg.Retries+1)
+}
+
+func (n *Notifier) post(cfg WebhookConfig, body []byte, eventID string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gocam")
+	req.Header.Set("X-Gocam-Event", eventID)
+	if cfg.Secret != "" {
+		req.Header.Set("X-Gocam-Signature", "sha256="+signPayload(cfg.Secret, body))
+	}
+
+	client := *n.client
+	client.Timeout = cfg.Timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of body, which receivers compare
+// against the X-Gocam-Signature header.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Notifier) payload(cfg WebhookConfig, e Event) WebhookPayload {
+	p := WebhookPayload{ID: e.ID, Type: e.Kind, Time: e.Time, Camera: e.Camera, Detections: e.Detections, Track: e.Track,
+		Line: e.Line, Direction: e.Direction, Rule: e.Rule, Dwell: e.Dwell, Clip: e.Clip}
+	if e.Snapshot == "" {
+		return p
+	}
+
+	switch cfg.Snapshot {
+	case "base64":
+		jpeg, err := readArchive(e.Camera, e.Snapshot)
+		if err != nil {
+			log.Printf("[WARN]: Webhook %v: unable to read snapshot %v: %v\n", cfg.Name, e.Snapshot, err)
+		}
+		p.SnapshotJPEG = jpeg
+	case "url":
+		// Signed, as receivers have no credentials of their own
+		path := "/archives/" + e.Camera + "/" + e.Snapshot
+		p.SnapshotURL = n.publicURL + "/archives/" + url.PathEscape(e.Camera) + "/" + url.PathEscape(e.Snapshot) + authenticator.signedQuery(path)
+	}
+	return p
+}
+
+// logDelivery appends d to the delivery log, moving the log to
+// logPath.1 once it reaches logMaxSize, and keeps it among the recent ones.
+func (n *Notifier) logDelivery(d WebhookDelivery) {
+	n.logMut.Lock()
+	defer n.logMut.Unlock()
+	n.remember(d)
+
+	js, err := json.Marshal(d)
+	if err == nil {
+		var file *os.File
+		file, err = os.OpenFile(n.logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.Write(append(js, '\n'))
+			var info os.FileInfo
+			if info, err = file.Stat(); err == nil && n.logMaxSize > 0 && info.Size() >= n.logMaxSize {
+				err = os.Rename(n.logPath, n.logPath+".1")
+			}
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR]: Unable to write webhook delivery log: %v\n", err)
+	}
+}
+
+// remember keeps d among the last maxDeliveries, overwriting the oldest.
+func (n *Notifier) remember(d WebhookDelivery) {
+	if len(n.recent) < maxDeliveries {
+		n.recent = append(n.recent, d)
+	} else {
+		n.recent[n.next] = d
+	}
+	n.next = (n.next + 1) % maxDeliveries
+}
+
+// loadDeliveries remembers the deliveries logged by earlier runs.
+func (n *Notifier) loadDeliveries() error {
+	for _, path := range []string{n.logPath + ".1", n.logPath} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var d WebhookDelivery
+			if json.Unmarshal(scanner.Bytes(), &d) == nil {
+				n.remember(d)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecentDeliveries returns up to limit of the latest delivery attempts,
+// newest first. Only the last maxDeliveries are kept in memory.
+func (n *Notifier) RecentDeliveries(limit int) []WebhookDelivery {
+	n.logMut.Lock()
+	defer n.logMut.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for i := 1; i <= len(n.recent) && i <= limit; i++ {
+		deliveries = append(deliveries, n.recent[(n.next-i+len(n.recent))%len(n.recent)])
+	}
+	return deliveries
+}
+
+// WebhookDeliveriesHandler serves GET /api/webhooks/deliveries?limit=
+func WebhookDeliveriesHandler(w http.ResponseWriter, request *http.Request) {
+	setupResponse(&w, request)
+	limit := 50
+	if v := request.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxDeliveries {
+			http.Error(w, fmt.Sprintf("invalid limit: must be between 1 and %d", maxDeliveries), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, notifier.RecentDeliveries(limit))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test server that answers with statuses in turn,
+// repeating the last one, and records every request.
+type webhookReceiver struct {
+	*httptest.Server
+	mut      sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan string
+}
+
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{statuses: statuses, received: make(chan string, 100)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mut.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status = r.statuses[minInt(len(r.requests), len(r.statuses)-1)]
+		}
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		r.mut.Unlock()
+		w.WriteHeader(status)
+		r.received <- req.Header.Get("X-Gocam-Event")
+	}))
+	return r
+}
+
+func (r *webhookReceiver) count() int {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return len(r.requests)
+}
+
+func (r *webhookReceiver) request(i int) (*http.Request, []byte) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.requests[i], r.bodies[i]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func newTestNotifier(t *testing.T, configs ...WebhookConfig) *Notifier {
+	n, err := newNotifier(configs, "http://gocam.local", filepath.Join(t.TempDir(), "webhooks.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = time.Millisecond
+	return n
+}
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"signed", "s3cret"},
+		{"unsigned", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newWebhookReceiver()
+			defer receiver.Close()
+			cfg := WebhookConfig{Name: "hook", URL: receiver.URL, Secret: tt.secret, Timeout: time.Second, Snapshot: "none"}
+			n := newTestNotifier(t)
+
+			n.deliver(cfg, Event{ID: "cam0-1", Time: time.Now(), Camera: "cam0", Kind: "motion"})
+			if receiver.count() != 1 {
+				t.Fatalf("got %d requests, want 1", receiver.count())
+			}
+
+			req, body := receiver.request(0)
+			signature := req.Header.Get("X-Gocam-Signature")
+			if tt.secret == "" {
+				if signature != "" {
+					t.Errorf("unsigned hook sent signature %q", signature)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(tt.secret))
+			mac.Write(body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("signature = %q, want %q", signature, want)
+			}
+
+			var payload WebhookPayload
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.ID != "cam0-1" || payload.Type != "motion" || payload.Camera != "cam0" {
+				t.Errorf("unexpected payload %+v", payload)
+			}
+		})
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		attempts int
+	}{
+		{"delivered", []int{200}, 3, 1},
+		{"server error retried", []int{500, 503, 204}, 3, 3},
+		{"rate limit retried", []int{429, 200}, 3, 2},
+		{"client error not retried", []int{400}, 3, 1},
+		{"gives up", []int{502}, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(tt.statuses...)
+			defer receiver.Close()
+			cfg := WebhookConfig{Name: "hook", URL: receiver.URL, Retries: tt.retries, Timeout: time.Second, Snapshot: "none"}
+			n := newTestNotifier(t)
+
+			n.deliver(cfg, Event{ID: "cam0-1", Time: time.Now(), Camera: "cam0", Kind: "face"})
+			if receiver.count() != tt.attempts {
+				t.Errorf("got %d attempts, want %d", receiver.count(), tt.attempts)
+			}
+
+			// Every attempt is logged, newest first
+			deliveries := n.RecentDeliveries(10)
+			if len(deliveries) != tt.attempts {
+				t.Fatalf("logged %d deliveries, want %d", len(deliveries), tt.attempts)
+			}
+			for i, d := range deliveries {
+				attempt := tt.attempts - i
+				want := tt.statuses[minInt(attempt-1, len(tt.statuses)-1)]
+				if d.Attempt != attempt || d.Status != want || d.Hook != "hook" || d.Event != "cam0-1" {
+					t.Errorf("deliveries[%d] = %+v, want attempt %d with status %d", i, d, attempt, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	receiver := newWebhookReceiver(500)
+	defer receiver.Close()
+	cfg := WebhookConfig{Name: "hook", URL: receiver.URL, Retries: 3, Timeout: time.Second, Snapshot: "none"}
+	n := newTestNotifier(t)
+	n.backoff = 20 * time.Millisecond
+
+	// Waits of 20ms, 40ms and 80ms between the four attempts
+	start := time.Now()
+	n.deliver(cfg, Event{ID: "cam0-1", Time: time.Now()})
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("four attempts took %v; backoff should double from 20ms", elapsed)
+	}
+	if receiver.count() != 4 {
+		t.Errorf("got %d attempts, want 4", receiver.count())
+	}
+}
+
+func TestWebhookNetworkErrorRetried(t *testing.T) {
+	receiver := newWebhookReceiver()
+	url := receiver.URL
+	receiver.Close()
+	cfg := WebhookConfig{Name: "hook", URL: url, Retries: 1, Timeout: time.Second, Snapshot: "none"}
+	n := newTestNotifier(t)
+
+	n.deliver(cfg, Event{ID: "cam0-1", Time: time.Now()})
+	deliveries := n.RecentDeliveries(10)
+	if len(deliveries) != 2 {
+		t.Fatalf("logged %d deliveries, want 2", len(deliveries))
+	}
+	for _, d := range deliveries {
+		if d.Error == "" || d.Status != 0 {
+			t.Errorf("delivery %+v should record the connection error", d)
+		}
+	}
+}
+
+func TestWebhookCooldownAndFilters(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+	n := newTestNotifier(t, WebhookConfig{
+		Name: "hook", URL: receiver.URL, Kinds: []string{"face"}, Cameras: []string{"front"},
+		Cooldown: 5 * time.Second, Timeout: time.Second, Snapshot: "none",
+	})
+
+	start := time.Now()
+	events := []Event{
+		{ID: "sent", Time: start, Camera: "front", Kind: "face"},
+		{ID: "cooling-down", Time: start.Add(time.Second), Camera: "front", Kind: "face"},
+		{ID: "other-kind", Time: start.Add(6 * time.Second), Camera: "front", Kind: "motion"},
+		{ID: "other-camera", Time: start.Add(6 * time.Second), Camera: "back", Kind: "face"},
+		{ID: "sent-again", Time: start.Add(6 * time.Second), Camera: "front", Kind: "face"},
+	}
+	for _, e := range events {
+		n.Notify(e)
+	}
+
+	// Events are delivered in order, so the second one received proves the
+	// ones in between were skipped
+	for _, want := range []string{"sent", "sent-again"} {
+		select {
+		case got := <-receiver.received:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestRecentDeliveries(t *testing.T) {
+	n := newTestNotifier(t)
+	for attempt := 1; attempt <= 5; attempt++ {
+		n.logDelivery(WebhookDelivery{Time: time.Now(), Hook: "hook", Event: "e", Attempt: attempt})
+	}
+
+	tests := []struct {
+		limit int
+		want  []int
+	}{
+		{3, []int{5, 4, 3}},
+		{10, []int{5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		if got := deliveryAttempts(n.RecentDeliveries(tt.limit)); !equalInts(got, tt.want) {
+			t.Errorf("limit %d: got attempts %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func deliveryAttempts(deliveries []WebhookDelivery) []int {
+	attempts := []int{}
+	for _, d := range deliveries {
+		attempts = append(attempts, d.Attempt)
+	}
+	return attempts
+}
+
+func TestRecentDeliveriesWithoutLog(t *testing.T) {
+	n := newTestNotifier(t)
+	if deliveries := n.RecentDeliveries(10); len(deliveries) != 0 {
+		t.Errorf("RecentDeliveries() = %v, want no deliveries", deliveries)
+	}
+}
+
+func TestRecentDeliveriesBounded(t *testing.T) {
+	n := newTestNotifier(t)
+	for attempt := 1; attempt <= maxDeliveries+10; attempt++ {
+		n.logDelivery(WebhookDelivery{Time: time.Now(), Hook: "hook", Event: "e", Attempt: attempt})
+	}
+	if len(n.recent) != maxDeliveries {
+		t.Errorf("%d deliveries kept in memory, want %d", len(n.recent), maxDeliveries)
+	}
+	got := deliveryAttempts(n.RecentDeliveries(maxDeliveries))
+	if len(got) != maxDeliveries || got[0] != maxDeliveries+10 || got[len(got)-1] != 11 {
+		t.Errorf("got %d attempts from %d to %d, want %d from %d to 11", len(got), got[0], got[len(got)-1], maxDeliveries, maxDeliveries+10)
+	}
+}
+
+func TestDeliveryLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	n, err := newNotifier(nil, "http://gocam.local", path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a 1 byte cap every attempt rotates the log
+	for attempt := 1; attempt <= 3; attempt++ {
+		n.logDelivery(WebhookDelivery{Time: time.Now(), Hook: "hook", Event: "e", Attempt: attempt})
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log not rotated: %v", err)
+	}
+
+	// A restart remembers what is left in the log
+	if n, err = newNotifier(nil, "http://gocam.local", path, 0); err != nil {
+		t.Fatal(err)
+	}
+	n.logDelivery(WebhookDelivery{Time: time.Now(), Hook: "hook", Event: "e", Attempt: 4})
+	if got, want := deliveryAttempts(n.RecentDeliveries(10)), []int{4, 3}; !equalInts(got, want) {
+		t.Errorf("after restart got attempts %v, want %v", got, want)
+	}
+}
+
+func TestWebhookPayloadSnapshotURL(t *testing.T) {
+	useAuthenticator(t, &Authenticator{})
+	n := newTestNotifier(t)
+	e := Event{ID: "front-1", Camera: "front", Kind: "face", Snapshot: "SNAP_face 1.jpg"}
+
+	p := n.payload(WebhookConfig{Snapshot: "url"}, e)
+	if want := "http://gocam.local/archives/front/SNAP_face%201.jpg"; p.SnapshotURL != want {
+		t.Errorf("SnapshotURL = %q, want %q", p.SnapshotURL, want)
+	}
+	if p = n.payload(WebhookConfig{Snapshot: "none"}, e); p.SnapshotURL != "" || p.SnapshotJPEG != nil {
+		t.Errorf("snapshot none still sent a snapshot: %+v", p)
+	}
+}
+
+func TestWebhookPayloadSignedSnapshotURL(t *testing.T) {
+	a := newTestAuthenticator(t)
+	useAuthenticator(t, a)
+	n := newTestNotifier(t)
+	e := Event{ID: "front-1", Camera: "front", Kind: "face", Snapshot: "SNAP_face 1.jpg"}
+
+	// Receivers have no credentials, so the link carries its own
+	p := n.payload(WebhookConfig{Snapshot: "url"}, e)
+	if !strings.HasPrefix(p.SnapshotURL, "http://gocam.local/archives/front/SNAP_face%201.jpg?") {
+		t.Fatalf("SnapshotURL = %q, want a signed link to the snapshot", p.SnapshotURL)
+	}
+	w := httptest.NewRecorder()
+	if !a.authorize(w, httptest.NewRequest("GET", p.SnapshotURL, nil), RoleViewer) {
+		t.Errorf("SnapshotURL refused with status %d", w.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// DetectionZone limits where detections count. Points are normalized to
+// 0..1 of the frame like privacy masks. A detection is in a zone when at
+// least MinOverlap of its bounding box lies inside the polygon.
+type DetectionZone struct {
+	Name   string
+	Points [][2]float64
+	// Type is "include" (default) or "exclude". When a camera has include
+	// zones only detections inside one of them count; detections inside an
+	// exclude zone never count.
+	Type string
+	// MinOverlap is the fraction of the bounding box, 0..1, that must be
+	// inside the zone (default 0.5).
+	MinOverlap float64
+}
+
+func (z *DetectionZone) validate() error {
+	if !validCameraID(z.Name) {
+		return fmt.Errorf("invalid zone name %q: use letters, digits, - and _", z.Name)
+	}
+	if len(z.Points) < 3 {
+		return fmt.Errorf("zone %v needs at least 3 points", z.Name)
+	}
+	for _, p := range z.Points {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return fmt.Errorf("zone %v: points must be between 0 and 1", z.Name)
+		}
+	}
+	if z.Type == "" {
+		z.Type = "include"
+	}
+	if z.Type != "include" && z.Type != "exclude" {
+		return fmt.Errorf("zone %v: type must be include or exclude", z.Name)
+	}
+	if z.MinOverlap == 0 {
+		z.MinOverlap = 0.5
+	}
+	if z.MinOverlap < 0 || z.MinOverlap > 1 {
+		return fmt.Errorf("zone %v: minOverlap must be between 0 and 1", z.Name)
+	}
+	return nil
+}
+
+// overlap returns the fraction of r inside the zone on a cols x rows frame.
+func (z DetectionZone) overlap(r image.Rectangle, cols, rows int) float64 {
+	if r.Empty() {
+		return 0
+	}
+	polygon := make([][2]float64, len(z.Points))
+	for i, p := range z.Points {
+		polygon[i] = [2]float64{p[0] * float64(cols), p[1] * float64(rows)}
+	}
+	inside := polygonArea(clipToRect(polygon, r))
+	return inside / float64(r.Dx()*r.Dy())
+}
+
+// clipToRect clips a polygon to a rectangle with the Sutherland-Hodgman
+// algorithm. The rectangle is convex, so the zone itself may be concave.
+func clipToRect(polygon [][2]float64, r image.Rectangle) [][2]float64 {
+	edges := []struct {
+		inside func(p [2]float64) bool
+		cross  func(a, b [2]float64) [2]float64
+	}{
+		{func(p [2]float64) bool { return p[0] >= float64(r.Min.X) }, func(a, b [2]float64) [2]float64 { return crossX(a, b, float64(r.Min.X)) }},
+		{func(p [2]float64) bool { return p[0] <= float64(r.Max.X) }, func(a, b [2]float64) [2]float64 { return crossX(a, b, float64(r.Max.X)) }},
+		{func(p [2]float64) bool { return p[1] >= float64(r.Min.Y) }, func(a, b [2]float64) [2]float64 { return crossY(a, b, float64(r.Min.Y)) }},
+		{func(p [2]float64) bool { return p[1] <= float64(r.Max.Y) }, func(a, b [2]float64) [2]float64 { return crossY(a, b, float64(r.Max.Y)) }},
+	}
+	out := polygon
+	for _, edge := range edges {
+		in := out
+		out = nil
+		for i, cur := range in {
+			prev := in[(i+len(in)-1)%len(in)]
+			if edge.inside(cur) {
+				if !edge.inside(prev) {
+					out = append(out, edge.cross(prev, cur))
+				}
+				out = append(out, cur)
+			} else if edge.inside(prev) {
+				out = append(out, edge.cross(prev, cur))
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+	}
+	return out
+}
+
+// crossX is where segment ab crosses the vertical line at x.
+func crossX(a, b [2]float64, x float64) [2]float64 {
+	t := (x - a[0]) / (b[0] - a[0])
+	return [2]float64{x, a[1] + t*(b[1]-a[1])}
+}
+
+// crossY is where segment ab crosses the horizontal line at y.
+func crossY(a, b [2]float64, y float64) [2]float64 {
+	t := (y - a[1]) / (b[1] - a[1])
+	return [2]float64{a[0] + t*(b[0]-a[0]), y}
+}
+
+// polygonArea is the shoelace formula.
+func polygonArea(polygon [][2]float64) float64 {
+	area := 0.0
+	for i, p := range polygon {
+		q := polygon[(i+1)%len(polygon)]
+		area += p[0]*q[1] - q[0]*p[1]
+	}
+	if area < 0 {
+		area = -area
+	}
+	return area / 2
+}
+
+// ZoneSet is one camera's detection zones.
+type ZoneSet struct {
+	include []DetectionZone
+	exclude []DetectionZone
+}
+
+func newZoneSet(zones []DetectionZone) (*ZoneSet, error) {
+	set := &ZoneSet{}
+	seen := map[string]bool{}
+	for _, zone := range zones {
+		if err := zone.validate(); err != nil {
+			return nil, err
+		}
+		if seen[zone.Name] {
+			return nil, fmt.Errorf("zone %v already exists", zone.Name)
+		}
+		seen[zone.Name] = true
+		if zone.Type == "exclude" {
+			set.exclude = append(set.exclude, zone)
+		} else {
+			set.include = append(set.include, zone)
+		}
+	}
+	return set, nil
+}
+
+// Filter drops detections outside the include zones or inside an exclude
+// zone. Each detection kept is labelled with the include zone it overlaps
+// most.
+func (s *ZoneSet) Filter(detections []Detection, cols, rows int) []Detection {
+	kept := []Detection{}
+	for _, d := range detections {
+		if zone, ok := s.zoneOf(d.Box, cols, rows); ok {
+			d.Zone = zone
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func (s *ZoneSet) hasInclude(name string) bool {
+	for _, z := range s.include {
+		if z.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ZoneSet) zoneOf(r image.Rectangle, cols, rows int) (string, bool) {
+	for _, z := range s.exclude {
+		if z.overlap(r, cols, rows) >= z.MinOverlap {
+			return "", false
+		}
+	}
+	if len(s.include) == 0 {
+		return "", true
+	}
+	best, bestOverlap := "", 0.0
+	for _, z := range s.include {
+		if o := z.overlap(r, cols, rows); o >= z.MinOverlap && o > bestOverlap {
+			best, bestOverlap = z.Name, o
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// rectZone is an include zone covering x0..x1, y0..y1 of the frame.
+func rectZone(name string, x0, y0, x1, y1 float64) DetectionZone {
+	return DetectionZone{Name: name, Points: [][2]float64{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}}}
+}
+
+func TestDetectionZoneValidate(t *testing.T) {
+	zone := rectZone("yard", 0, 0, 1, 1)
+	if err := zone.validate(); err != nil || zone.Type != "include" || zone.MinOverlap != 0.5 {
+		t.Errorf("validate() = %v with %+v, want the include type and an overlap of 0.5", err, zone)
+	}
+
+	tests := []struct {
+		name string
+		zone func(z *DetectionZone)
+	}{
+		{"no name", func(z *DetectionZone) { z.Name = "" }},
+		{"two points", func(z *DetectionZone) { z.Points = z.Points[:2] }},
+		{"outside the frame", func(z *DetectionZone) { z.Points[0][0] = 1.1 }},
+		{"unknown type", func(z *DetectionZone) { z.Type = "ignore" }},
+		{"overlap above one", func(z *DetectionZone) { z.MinOverlap = 1.5 }},
+		{"negative overlap", func(z *DetectionZone) { z.MinOverlap = -0.5 }},
+	}
+	for _, tt := range tests {
+		zone := rectZone("yard", 0, 0, 1, 1)
+		tt.zone(&zone)
+		if err := zone.validate(); err == nil {
+			t.Errorf("%v: validate() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestDetectionZoneOverlap(t *testing.T) {
+	triangle := DetectionZone{Points: [][2]float64{{0, 0}, {1, 0}, {0, 1}}}
+	// An L without the top right quarter
+	concave := DetectionZone{Points: [][2]float64{{0, 0}, {0.5, 0}, {0.5, 0.5}, {1, 0.5}, {1, 1}, {0, 1}}}
+	tests := []struct {
+		name string
+		zone DetectionZone
+		box  image.Rectangle
+		want float64
+	}{
+		{"inside", triangle, image.Rect(0, 0, 50, 50), 1},
+		{"touching a corner", triangle, image.Rect(50, 50, 100, 100), 0},
+		{"cut by the diagonal", triangle, image.Rect(0, 50, 50, 100), 0.5},
+		{"outside the frame", triangle, image.Rect(100, 100, 120, 120), 0},
+		{"empty box", triangle, image.Rect(10, 10, 10, 30), 0},
+		{"in the notch", concave, image.Rect(50, 0, 100, 50), 0},
+		{"across the notch", concave, image.Rect(25, 25, 75, 75), 0.75},
+		{"around the zone", concave, image.Rect(-100, -100, 200, 200), 0.75 * 100 * 100 / (300 * 300)},
+	}
+	for _, tt := range tests {
+		if got := tt.zone.overlap(tt.box, 100, 100); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v: overlap(%v) = %v, want %v", tt.name, tt.box, got, tt.want)
+		}
+	}
+}
+
+func TestPolygonArea(t *testing.T) {
+	square := [][2]float64{{0, 0}, {2, 0}, {2, 2}, {0, 2}}
+	reversed := [][2]float64{{0, 2}, {2, 2}, {2, 0}, {0, 0}}
+	for _, polygon := range [][][2]float64{square, reversed} {
+		if got := polygonArea(polygon); got != 4 {
+			t.Errorf("polygonArea(%v) = %v, want 4", polygon, got)
+		}
+	}
+	if got := polygonArea(nil); got != 0 {
+		t.Errorf("polygonArea(nil) = %v, want 0", got)
+	}
+}
+
+func TestZoneSetFilter(t *testing.T) {
+	tree := rectZone("tree", 0, 0, 0.2, 0.2)
+	tree.Type, tree.MinOverlap = "exclude", 0.1
+	tests := []struct {
+		name  string
+		zones []DetectionZone
+		box   image.Rectangle
+		// zone is the zone the detection is labelled with, or "-" when it
+		// is dropped
+		zone string
+	}{
+		{"no zones", nil, image.Rect(0, 0, 10, 10), ""},
+		{"in one zone", []DetectionZone{rectZone("yard", 0, 0, 0.6, 1), rectZone("street", 0.4, 0, 1, 1)}, image.Rect(0, 50, 20, 70), "yard"},
+		{"best overlap wins", []DetectionZone{rectZone("yard", 0, 0, 0.6, 1), rectZone("street", 0.4, 0, 1, 1)}, image.Rect(45, 50, 65, 70), "street"},
+		{"below the minimum overlap", []DetectionZone{rectZone("yard", 0, 0, 0.6, 1)}, image.Rect(50, 0, 80, 20), "-"},
+		{"outside every zone", []DetectionZone{rectZone("yard", 0, 0, 0.6, 1)}, image.Rect(70, 70, 90, 90), "-"},
+		{"excluded", []DetectionZone{rectZone("yard", 0, 0, 0.6, 1), tree}, image.Rect(10, 10, 30, 30), "-"},
+		{"only exclude zones", []DetectionZone{tree}, image.Rect(50, 50, 70, 70), ""},
+		{"excluded without include zones", []DetectionZone{tree}, image.Rect(0, 0, 20, 20), "-"},
+	}
+	for _, tt := range tests {
+		set, err := newZoneSet(tt.zones)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := set.Filter([]Detection{{Label: "person", Box: tt.box}}, 100, 100)
+		switch {
+		case tt.zone == "-" && len(kept) != 0:
+			t.Errorf("%v: kept %+v, want it dropped", tt.name, kept)
+		case tt.zone != "-" && (len(kept) != 1 || kept[0].Zone != tt.zone):
+			t.Errorf("%v: kept %+v, want it in zone %q", tt.name, kept, tt.zone)
+		}
+	}
+}
+
+func TestNewZoneSetErrors(t *testing.T) {
+	bad := rectZone("yard", 0, 0, 1, 1)
+	bad.Type = "ignore"
+	for _, zones := range [][]DetectionZone{
+		{bad},
+		{rectZone("yard", 0, 0, 0.5, 1), rectZone("yard", 0.5, 0, 1, 1)},
+	} {
+		if _, err := newZoneSet(zones); err == nil {
+			t.Errorf("newZoneSet(%+v) succeeded, want an error", zones)
+		}
+	}
+}